@@ -0,0 +1,193 @@
+package k2tree
+
+import (
+	"fmt"
+
+	"github.com/barakmich/k2tree/bytearray"
+)
+
+// BackendKind selects the bitarray implementation that stores a set of bits.
+type BackendKind int
+
+const (
+	// DefaultBackend uses the default storage for the bits: PagedSliceBackend
+	// with an LRUIndex for the tree, and PagedBitBackend for the leaves.
+	DefaultBackend BackendKind = iota
+	// SliceBackend stores the bits in a single contiguous slice.
+	SliceBackend
+	// PagedSliceBackend stores the bits in slices that are split in half once
+	// they reach PageSize bits.
+	PagedSliceBackend
+	// PagedBitBackend stores the bits in fixed pages of PageSize bytes, spilling
+	// into the next page once a page is more than HighWater full, down to
+	// LowWater.
+	PagedBitBackend
+	// ByteSliceBackend stores the bits in a bytearray.SliceArray.
+	ByteSliceBackend
+	// FrontSliceBackend stores the bits in a bytearray.FrontSlice, which
+	// starts with room for PageSize bytes.
+	FrontSliceBackend
+	// BytePagedBackend stores the bits in a bytearray.PagedArray, with the
+	// same parameters as PagedBitBackend.
+	BytePagedBackend
+	// SpilloverBackend stores the bits in a bytearray.SpilloverArray with
+	// levels of PageSize bytes, doubling at each level, with the same water
+	// marks as PagedBitBackend.
+	SpilloverBackend
+)
+
+// IndexKind selects the rank index, if any, kept over a bitarray to speed up
+// Count.
+type IndexKind int
+
+const (
+	NoIndex IndexKind = iota
+	// LRUIndex caches up to LRUSize counts at offsets at least CacheDistance
+	// bits apart.
+	LRUIndex
+	// Int16Index keeps a count for every 64Kib of the array.
+	Int16Index
+	// QuartileIndex keeps counts at each quarter of the array.
+	QuartileIndex
+	// FenwickIndex keeps counts for blocks of about FenwickBlock bits of the
+	// array in a Fenwick tree, for logarithmic Count and Set.
+	FenwickIndex
+)
+
+// Backend describes the storage of a set of bits and its tuning parameters.
+// Zero parameters take their defaults.
+type Backend struct {
+	Kind      BackendKind
+	PageSize  int
+	HighWater float64
+	// LowWater is the fraction of a page that's left in it when it spills,
+	// 0.3 if nil. It's a pointer so that a LowWater of zero, which spills
+	// pages empty, can be told apart from an unset one; see WaterMark.
+	LowWater      *float64
+	Index         IndexKind
+	LRUSize       int
+	CacheDistance int
+	// FenwickBlock is the target number of bits counted by each block of a
+	// FenwickIndex, 4096 by default.
+	FenwickBlock int
+}
+
+// WaterMark returns a pointer to f, for setting Backend.LowWater.
+func WaterMark(f float64) *float64 {
+	return &f
+}
+
+var defaultTreeBackend = Backend{
+	Kind:          PagedSliceBackend,
+	PageSize:      1024 * 128,
+	Index:         LRUIndex,
+	LRUSize:       128,
+	CacheDistance: DefaultLRUCacheDistance,
+}
+
+var defaultLeafBackend = Backend{
+	Kind:      PagedBitBackend,
+	PageSize:  1024 * 128,
+	HighWater: 0.8,
+	LowWater:  WaterMark(0.3),
+}
+
+// withDefaults fills in the unset parameters of b from def. If b is the
+// DefaultBackend, it's replaced by def entirely.
+func (b Backend) withDefaults(def Backend) Backend {
+	if b.Kind == DefaultBackend {
+		return def
+	}
+	if b.PageSize == 0 {
+		b.PageSize = 1024 * 128
+	}
+	if b.HighWater == 0 {
+		b.HighWater = 0.8
+	}
+	if b.LowWater == nil {
+		b.LowWater = WaterMark(0.3)
+	}
+	if b.LRUSize == 0 {
+		b.LRUSize = 128
+	}
+	if b.CacheDistance == 0 {
+		b.CacheDistance = DefaultLRUCacheDistance
+	}
+	if b.FenwickBlock == 0 {
+		b.FenwickBlock = fenwickBlockBits
+	}
+	return b
+}
+
+// newFunc returns a constructor for the bitarray b describes.
+func (b Backend) newFunc() (newBitArrayFunc, error) {
+	if b.PageSize <= 0 {
+		return nil, fmt.Errorf("invalid page size %d", b.PageSize)
+	}
+	var base newBitArrayFunc
+	switch b.Kind {
+	case SliceBackend:
+		base = func() bitarray {
+			return newSliceArray()
+		}
+	case PagedSliceBackend:
+		base = func() bitarray {
+			return newPagedSliceArray(b.PageSize)
+		}
+	case PagedBitBackend, BytePagedBackend, SpilloverBackend:
+		low := *b.LowWater
+		if b.HighWater < low || low < 0 || b.HighWater > 1 {
+			return nil, fmt.Errorf("invalid water marks: high %v, low %v", b.HighWater, low)
+		}
+		switch b.Kind {
+		case PagedBitBackend:
+			base = func() bitarray {
+				return newPagedBitarray(b.PageSize, b.HighWater, low)
+			}
+		case BytePagedBackend:
+			base = func() bitarray {
+				return newByteArray(bytearray.NewPaged(b.PageSize, b.HighWater, low))
+			}
+		default:
+			base = func() bitarray {
+				return newByteArray(bytearray.NewSpillover(b.PageSize, b.HighWater, low, true))
+			}
+		}
+	case ByteSliceBackend:
+		base = func() bitarray {
+			return newByteArray(bytearray.NewSlice())
+		}
+	case FrontSliceBackend:
+		base = func() bitarray {
+			return newByteArray(bytearray.NewFrontSlice(b.PageSize))
+		}
+	default:
+		return nil, fmt.Errorf("unknown backend kind %d", b.Kind)
+	}
+	switch b.Index {
+	case NoIndex:
+		return base, nil
+	case LRUIndex:
+		return func() bitarray {
+			lru := newBinaryLRUIndex(base(), b.LRUSize)
+			lru.cacheDistance = b.CacheDistance
+			return lru
+		}, nil
+	case Int16Index:
+		return func() bitarray {
+			return newInt16Index(base())
+		}, nil
+	case QuartileIndex:
+		return func() bitarray {
+			return newQuartileIndex(base())
+		}, nil
+	case FenwickIndex:
+		if b.FenwickBlock <= 0 {
+			return nil, fmt.Errorf("invalid Fenwick block size %d", b.FenwickBlock)
+		}
+		return func() bitarray {
+			return newFenwickIndex(base(), b.FenwickBlock)
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown index kind %d", b.Index)
+}
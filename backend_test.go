@@ -0,0 +1,86 @@
+package k2tree
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestBackendConfig(t *testing.T) {
+	backends := []Backend{
+		{},
+		{Kind: SliceBackend},
+		{Kind: SliceBackend, Index: Int16Index},
+		{Kind: PagedSliceBackend, PageSize: 1024, Index: LRUIndex, LRUSize: 16, CacheDistance: 64},
+		{Kind: PagedBitBackend, PageSize: 512, HighWater: 0.9, LowWater: WaterMark(0.5)},
+		{Kind: PagedBitBackend, Index: QuartileIndex},
+		{Kind: ByteSliceBackend},
+		{Kind: PagedSliceBackend, PageSize: 1024, Index: FenwickIndex},
+		{Kind: FrontSliceBackend, PageSize: 16},
+		{Kind: BytePagedBackend, PageSize: 64, Index: LRUIndex},
+		{Kind: SpilloverBackend, PageSize: 64, HighWater: 0.75, LowWater: WaterMark(0.5)},
+		{Kind: PagedBitBackend, PageSize: 64, LowWater: WaterMark(0)},
+		{Kind: BytePagedBackend, PageSize: 64},
+		{Kind: SpilloverBackend, PageSize: 64},
+		{Kind: SliceBackend, Index: FenwickIndex, FenwickBlock: 64},
+	}
+	for x, tree := range backends {
+		for y, cell := range backends {
+			t.Run(fmt.Sprint(x, "-", y), func(t *testing.T) {
+				config := SixteenFourConfig
+				config.TreeBackend = tree
+				config.CellBackend = cell
+				k2, err := NewWithConfig(config)
+				if err != nil {
+					t.Fatal(err)
+				}
+				simpleLoad(k2)
+				checkIterator(t, k2.From(20), []int{1, 2, 14, 17, 30, 41})
+			})
+		}
+	}
+	if lru, ok := mustTree(t, Backend{Kind: SliceBackend, Index: LRUIndex, CacheDistance: 64}).tbits.(*binaryLRUIndex); !ok || lru.cacheDistance != 64 {
+		t.Error("cache distance was not applied")
+	}
+	if f := mustTree(t, Backend{Kind: SliceBackend, Index: FenwickIndex, FenwickBlock: 256}).tbits.(*fenwickIndex); f.block != 256 {
+		t.Errorf("expected a Fenwick block of 256, got %d", f.block)
+	}
+	if f := mustTree(t, Backend{Kind: SliceBackend, Index: FenwickIndex}).tbits.(*fenwickIndex); f.block != fenwickBlockBits {
+		t.Errorf("expected the default Fenwick block, got %d", f.block)
+	}
+	for _, c := range []struct {
+		low      *float64
+		expected int
+	}{{WaterMark(0), 0}, {nil, 300}, {WaterMark(0.5), 500}} {
+		b := Backend{Kind: PagedBitBackend, PageSize: 1000, LowWater: c.low}
+		if low := mustTree(t, b).tbits.(*pagedBitarray).low; low != c.expected {
+			t.Errorf("expected a low water mark of %d, got %d", c.expected, low)
+		}
+	}
+}
+
+func TestBackendConfigErrors(t *testing.T) {
+	for _, b := range []Backend{
+		{Kind: BackendKind(100)},
+		{Kind: SliceBackend, Index: IndexKind(100)},
+		{Kind: PagedBitBackend, HighWater: 0.2, LowWater: WaterMark(0.5)},
+		{Kind: PagedSliceBackend, PageSize: -1},
+		{Kind: PagedBitBackend, LowWater: WaterMark(-0.1)},
+		{Kind: SliceBackend, Index: FenwickIndex, FenwickBlock: -1},
+	} {
+		config := DefaultConfig
+		config.CellBackend = b
+		if _, err := NewWithConfig(config); err == nil {
+			t.Errorf("expected an error for %#v", b)
+		}
+	}
+}
+
+func mustTree(t *testing.T, tree Backend) *K2Tree {
+	config := DefaultConfig
+	config.TreeBackend = tree
+	k2, err := NewWithConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k2
+}
@@ -1,6 +1,12 @@
 package k2tree
 
-type bitarray interface {
+import "fmt"
+
+// BitArray is the storage for the bits of a K2Tree. A K2Tree only ever
+// inserts bits in multiples of four (nibbles), at offsets that are multiples
+// of four, so implementations may reject anything else. The bitarraytest
+// package holds a conformance suite for implementations.
+type BitArray interface {
 	// Len returns the number of bits in the bitarray.
 	Len() int
 	// Set sets the bit at an index `at` to the value `val`.
@@ -17,7 +23,33 @@ type bitarray interface {
 	// Insert(3, 2)
 	// Resulting string: 11000101
 	Insert(n int, at int) error
+}
+
+type bitarray interface {
+	BitArray
 	debug() string
 }
 
 type newBitArrayFunc func() bitarray
+
+// userArray adapts a BitArray from outside the package to a bitarray.
+type userArray struct {
+	BitArray
+}
+
+var _ bitarray = userArray{}
+
+func (u userArray) debug() string {
+	return fmt.Sprintf("%T L%d T%d", u.BitArray, u.Len(), u.Total())
+}
+
+// wrapBitArrayFunc adapts a constructor of BitArrays to a newBitArrayFunc.
+func wrapBitArrayFunc(f func() BitArray) newBitArrayFunc {
+	return func() bitarray {
+		b := f()
+		if ba, ok := b.(bitarray); ok {
+			return ba
+		}
+		return userArray{b}
+	}
+}
@@ -280,6 +280,12 @@ var unindexedBitArrayTypes []bitArrayType = []bitArrayType{
 		},
 		name: "ByteArray:Paged:4096:80:30",
 	},
+	{
+		create: func() bitarray {
+			return newByteArray(bytearray.NewSpillover(4096, 0.8, 0.3, true))
+		},
+		name: "ByteArray:Spillover:4096x:80:30",
+	},
 }
 
 var tenMillionBitArrayTypes []bitArrayType = []bitArrayType{
@@ -310,6 +316,18 @@ var fastBitArrayTypes []bitArrayType = []bitArrayType{
 		},
 		name: "Int16Paged128kb",
 	},
+	{
+		create: func() bitarray {
+			return newFenwickIndex(&sliceArray{}, fenwickBlockBits)
+		},
+		name: "Fenwick4k",
+	},
+	{
+		create: func() bitarray {
+			return newFenwickIndex(newPagedSliceArray(128*1024), fenwickBlockBits)
+		},
+		name: "Fenwick4kPaged128kb",
+	},
 	{
 		create: func() bitarray {
 			return newInt16Index(newByteArray(bytearray.NewSlice()))
@@ -0,0 +1,16 @@
+package k2tree_test
+
+import (
+	"testing"
+
+	"github.com/barakmich/k2tree"
+	"github.com/barakmich/k2tree/bitarraytest"
+)
+
+func TestBitarrayTypes(t *testing.T) {
+	for _, ba := range k2tree.BitArrayTypes() {
+		t.Run(ba.Name, func(t *testing.T) {
+			bitarraytest.Run(t, ba.Create)
+		})
+	}
+}
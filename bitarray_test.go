@@ -1,33 +1,16 @@
 package k2tree
 
 import (
-	"fmt"
 	"testing"
 
 	"github.com/barakmich/k2tree/bytearray"
 )
 
-var curFunc newBitArrayFunc
-
-type testFunc struct {
-	testcase func(t *testing.T)
-	name     string
-}
-
 type bitArrayType struct {
 	create newBitArrayFunc
 	name   string
 }
 
-var testFuncs []testFunc = []testFunc{
-	{testSmoke, "TestSmoke"},
-	{testEasyInsert, "TestEasyInsert"},
-	{testByteInsert, "TestByteInsert"},
-	{testNibbleInsert, "TestNibbleInsert"},
-	{testNibbleInsert, "TestNibbleInsertAtZero"},
-	{testDebug, "TestDebug"},
-}
-
 var debugBitArrayTypes []bitArrayType = []bitArrayType{
 	{
 		create: func() bitarray {
@@ -74,6 +57,18 @@ var testBitArrayTypes []bitArrayType = []bitArrayType{
 		},
 		name: "BAPaged1k8030",
 	},
+	{
+		create: func() bitarray {
+			return newByteArray(bytearray.NewFrontSlice(16))
+		},
+		name: "BAFront",
+	},
+	{
+		create: func() bitarray {
+			return newByteArray(bytearray.NewSpillover(64, 0.8, 0.3, true))
+		},
+		name: "BASpillover64x8030",
+	},
 	{
 		create: func() bitarray {
 			return newQuartileIndex(&sliceArray{})
@@ -92,6 +87,18 @@ var testBitArrayTypes []bitArrayType = []bitArrayType{
 		},
 		name: "BAInt16",
 	},
+	{
+		create: func() bitarray {
+			return newFenwickIndex(&sliceArray{}, 64)
+		},
+		name: "Fenwick64",
+	},
+	{
+		create: func() bitarray {
+			return newFenwickIndex(newPagedSliceArray(1000), 100)
+		},
+		name: "Fenwick100Paged1k",
+	},
 	{
 		create: func() bitarray {
 			return newBinaryLRUIndex(newPagedBitarray(1024*128, 0.8, 0.3), 64)
@@ -112,135 +119,60 @@ var testBitArrayTypes []bitArrayType = []bitArrayType{
 	},
 }
 
-func TestBitarrayTypes(t *testing.T) {
-	for _, bitarray := range testBitArrayTypes {
-		curFunc = bitarray.create
-		for _, testcase := range testFuncs {
-			t.Run(fmt.Sprintf("%s%s", testcase.name, bitarray.name), testcase.testcase)
-		}
-	}
-	for _, bitarray := range debugBitArrayTypes {
-		curFunc = bitarray.create
-		for _, testcase := range testFuncs {
-			t.Run(fmt.Sprintf("%s%s", testcase.name, bitarray.name), testcase.testcase)
-		}
+func TestBitarrayDebug(t *testing.T) {
+	for _, ba := range append(testBitArrayTypes, debugBitArrayTypes...) {
+		ba.create().debug()
 	}
 }
 
-func testSmoke(t *testing.T) {
-	s := curFunc()
-	err := s.Insert(24, 0)
-	if err != nil {
-		t.Fatal(err)
-	}
-	s.Set(3, true)
-	if s.Count(0, 2) != 0 {
-		t.Error("wrong count")
-	}
-	if s.Count(2, 3) != 0 {
-		t.Error("end inclusive?")
-	}
-	if s.Count(2, 4) != 1 {
-		t.Error("can't count?")
-	}
-	if !s.Get(3) {
-		t.Error("can't retrieve?")
-	}
-	for x := 0; x < 24; x++ {
-		s.Set(x, true)
-	}
-	if s.Count(0, 8) != 8 {
-		t.Error("wrong count")
-	}
-	if s.Count(0, s.Len()) != 24 {
-		t.Error("wrong count")
-	}
-	if s.Total() != 24 {
-		t.Error("wrong total")
-	}
+// boolArray is a BitArray as a user outside the package might write it.
+type boolArray struct {
+	bits []bool
 }
 
-func testEasyInsert(t *testing.T) {
-	s := curFunc()
-	s.Insert(24, 0)
-	s.Set(3, true)
-	s.Insert(8, 0)
-	if s.Get(3) {
-		t.Error("new 3 should not be set")
-	}
-	if !s.Get(11) {
-		t.Error("new 11 should be set")
-	}
-	if s.Count(0, 32) != 1 {
-		t.Error("count is incorrect -- only one bit was set")
-	}
-}
+func (b *boolArray) Len() int             { return len(b.bits) }
+func (b *boolArray) Set(at int, val bool) { b.bits[at] = val }
+func (b *boolArray) Get(at int) bool      { return b.bits[at] }
+func (b *boolArray) Total() int           { return b.Count(0, len(b.bits)) }
 
-func testByteInsert(t *testing.T) {
-	s := curFunc()
-	s.Insert(24, 0)
-	s.Set(11, true)
-	s.Set(6, true)
-	s.Set(2, true)
-	s.Insert(8, 4)
-	if s.Get(11) {
-		t.Error("new 11 should not be set")
-	}
-	if !s.Get(19) {
-		t.Error("new 19 should be set")
-	}
-	if !s.Get(14) {
-		t.Error("new 14 should be set")
-	}
-	if !s.Get(2) {
-		t.Error("new 2 should be set")
+func (b *boolArray) Count(from, to int) int {
+	n := 0
+	for _, x := range b.bits[from:to] {
+		if x {
+			n++
+		}
 	}
-
+	return n
 }
 
-func testNibbleInsert(t *testing.T) {
-	s := curFunc()
-	s.Insert(24, 0)
-	s.Set(11, true)
-	s.Set(6, true)
-	s.Set(2, true)
-	s.Insert(4, 4)
-	if s.Get(11) {
-		t.Error("new 11 should not be set")
-	}
-	if !s.Get(15) {
-		t.Error("new 15 should be set")
-	}
-	if !s.Get(10) {
-		t.Error("new 10 should be set")
-	}
-	if !s.Get(2) {
-		t.Error("new 2 should be set")
-	}
-
+func (b *boolArray) Insert(n, at int) error {
+	b.bits = append(b.bits[:at], append(make([]bool, n), b.bits[at:]...)...)
+	return nil
 }
 
-func testNibbleInsertAtZero(t *testing.T) {
-	s := curFunc()
-	s.Insert(4, 0)
-	s.Set(3, true)
-	s.Set(0, true)
-	s.Insert(4, 0)
-	if s.Get(0) {
-		t.Error("got a wrong 0")
+func TestNewWithBitArrays(t *testing.T) {
+	newBools := func() BitArray {
+		return &boolArray{}
 	}
-	if s.Get(3) {
-		t.Error("got a wrong 3")
+	k2, err := NewWithBitArrays(newBools, newBools, DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
 	}
-	if !s.Get(4) {
-		t.Error("got no 4")
+	simpleLoad(k2)
+	k2.Remove(20, 41)
+	err = k2.Compact()
+	if err != nil {
+		t.Fatal(err)
 	}
-	if !s.Get(7) {
-		t.Error("got no 7")
+	if _, ok := k2.tbits.(userArray).BitArray.(*boolArray); !ok {
+		t.Error("tree bits are not stored in the user's array")
 	}
-}
+	checkIterator(t, k2.From(20), []int{1, 2, 14, 17, 30})
 
-func testDebug(t *testing.T) {
-	s := curFunc()
-	s.debug()
+	_, err = NewWithBitArrays(newBools, func() BitArray {
+		return &boolArray{bits: make([]bool, 8)}
+	}, DefaultConfig)
+	if err == nil {
+		t.Error("expected an error for a non-empty array")
+	}
 }
@@ -0,0 +1,195 @@
+// Package bitarraytest implements a conformance suite for storage supplied to
+// k2tree through the BitArray interface.
+package bitarraytest
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/barakmich/k2tree"
+)
+
+// Run runs the conformance suite as subtests of t. create must return a new,
+// empty BitArray on every call.
+func Run(t *testing.T, create func() k2tree.BitArray) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, s k2tree.BitArray)
+	}{
+		{"Smoke", testSmoke},
+		{"EasyInsert", testEasyInsert},
+		{"ByteInsert", testByteInsert},
+		{"NibbleInsert", testNibbleInsert},
+		{"NibbleInsertAtZero", testNibbleInsertAtZero},
+		{"Random", testRandom},
+	}
+	for _, tc := range tests {
+		test := tc.test
+		t.Run(tc.name, func(t *testing.T) {
+			s := create()
+			if s.Len() != 0 || s.Total() != 0 {
+				t.Fatalf("new bitarray is not empty: length %d, total %d", s.Len(), s.Total())
+			}
+			test(t, s)
+		})
+	}
+}
+
+func mustInsert(t *testing.T, s k2tree.BitArray, n, at int) {
+	t.Helper()
+	err := s.Insert(n, at)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testSmoke(t *testing.T, s k2tree.BitArray) {
+	mustInsert(t, s, 24, 0)
+	s.Set(3, true)
+	if s.Count(0, 2) != 0 {
+		t.Error("wrong count")
+	}
+	if s.Count(2, 3) != 0 {
+		t.Error("end inclusive?")
+	}
+	if s.Count(2, 4) != 1 {
+		t.Error("can't count?")
+	}
+	if !s.Get(3) {
+		t.Error("can't retrieve?")
+	}
+	for x := 0; x < 24; x++ {
+		s.Set(x, true)
+	}
+	if s.Count(0, 8) != 8 {
+		t.Error("wrong count")
+	}
+	if s.Count(0, s.Len()) != 24 {
+		t.Error("wrong count")
+	}
+	if s.Total() != 24 {
+		t.Error("wrong total")
+	}
+}
+
+func testEasyInsert(t *testing.T, s k2tree.BitArray) {
+	mustInsert(t, s, 24, 0)
+	s.Set(3, true)
+	mustInsert(t, s, 8, 0)
+	if s.Get(3) {
+		t.Error("new 3 should not be set")
+	}
+	if !s.Get(11) {
+		t.Error("new 11 should be set")
+	}
+	if s.Count(0, 32) != 1 {
+		t.Error("count is incorrect -- only one bit was set")
+	}
+}
+
+func testByteInsert(t *testing.T, s k2tree.BitArray) {
+	mustInsert(t, s, 24, 0)
+	s.Set(11, true)
+	s.Set(6, true)
+	s.Set(2, true)
+	mustInsert(t, s, 8, 4)
+	if s.Get(11) {
+		t.Error("new 11 should not be set")
+	}
+	if !s.Get(19) {
+		t.Error("new 19 should be set")
+	}
+	if !s.Get(14) {
+		t.Error("new 14 should be set")
+	}
+	if !s.Get(2) {
+		t.Error("new 2 should be set")
+	}
+}
+
+func testNibbleInsert(t *testing.T, s k2tree.BitArray) {
+	mustInsert(t, s, 24, 0)
+	s.Set(11, true)
+	s.Set(6, true)
+	s.Set(2, true)
+	mustInsert(t, s, 4, 4)
+	if s.Get(11) {
+		t.Error("new 11 should not be set")
+	}
+	if !s.Get(15) {
+		t.Error("new 15 should be set")
+	}
+	if !s.Get(10) {
+		t.Error("new 10 should be set")
+	}
+	if !s.Get(2) {
+		t.Error("new 2 should be set")
+	}
+}
+
+func testNibbleInsertAtZero(t *testing.T, s k2tree.BitArray) {
+	mustInsert(t, s, 4, 0)
+	s.Set(3, true)
+	s.Set(0, true)
+	mustInsert(t, s, 4, 0)
+	if s.Get(0) {
+		t.Error("got a wrong 0")
+	}
+	if s.Get(3) {
+		t.Error("got a wrong 3")
+	}
+	if !s.Get(4) {
+		t.Error("got no 4")
+	}
+	if !s.Get(7) {
+		t.Error("got no 7")
+	}
+}
+
+// testRandom applies a random sequence of inserts and sets to s and to a
+// plain slice of bools, checking that they agree throughout.
+func testRandom(t *testing.T, s k2tree.BitArray) {
+	var ref []bool
+	for x := 0; x < 1000; x++ {
+		if len(ref) == 0 || rand.Intn(3) == 0 {
+			n := 4 * (1 + rand.Intn(16))
+			at := 4 * rand.Intn(len(ref)/4+1)
+			mustInsert(t, s, n, at)
+			ref = append(ref[:at], append(make([]bool, n), ref[at:]...)...)
+		} else {
+			at := rand.Intn(len(ref))
+			val := rand.Intn(2) == 0
+			s.Set(at, val)
+			ref[at] = val
+		}
+		if s.Len() != len(ref) {
+			t.Fatalf("step %d: length %d, expected %d", x, s.Len(), len(ref))
+		}
+		from := rand.Intn(len(ref) + 1)
+		to := from + rand.Intn(len(ref)-from+1)
+		if got, expected := s.Count(from, to), countBools(ref[from:to]); got != expected {
+			t.Fatalf("step %d: Count(%d, %d) = %d, expected %d", x, from, to, got, expected)
+		}
+	}
+	for at, val := range ref {
+		if s.Get(at) != val {
+			t.Fatalf("Get(%d) = %v, expected %v", at, s.Get(at), val)
+		}
+	}
+	if got, expected := s.Total(), countBools(ref); got != expected {
+		t.Fatalf("Total() = %d, expected %d", got, expected)
+	}
+	if got, expected := s.Count(0, len(ref)), countBools(ref); got != expected {
+		t.Fatalf("Count(0, Len()) = %d, expected %d", got, expected)
+	}
+}
+
+func countBools(bs []bool) int {
+	n := 0
+	for _, b := range bs {
+		if b {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,138 @@
+package k2tree
+
+import "sort"
+
+// DefaultBufferSize is the number of links a BufferedK2Tree holds before it
+// flushes them into the tree.
+const DefaultBufferSize = 4096
+
+// BufferedK2Tree is a K2Tree that defers Adds. Every Add into a K2Tree may
+// shift most of the tree's bits, so new links are instead collected in a
+// small sorted buffer that queries consult alongside the tree. Once the
+// buffer fills, it's merged into the tree with AddBatch, which inserts the
+// blocks the buffer needs a level at a time.
+type BufferedK2Tree struct {
+	tree *K2Tree
+	// buf holds the links not yet in the tree, sorted by row then column.
+	buf  []link
+	size int
+}
+
+// NewBuffered creates a new BufferedK2Tree with the default creation options
+// and buffer size.
+func NewBuffered() (*BufferedK2Tree, error) {
+	return NewBufferedWithConfig(DefaultConfig, DefaultBufferSize)
+}
+
+// NewBufferedWithConfig creates a new BufferedK2Tree that flushes every size
+// links.
+func NewBufferedWithConfig(config Config, size int) (*BufferedK2Tree, error) {
+	if size <= 0 {
+		size = DefaultBufferSize
+	}
+	k, err := NewWithConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return &BufferedK2Tree{tree: k, size: size}, nil
+}
+
+// search returns the index in the buffer where the link from i to j is, or
+// would be inserted.
+func (b *BufferedK2Tree) search(i, j int) int {
+	return sort.Search(len(b.buf), func(x int) bool {
+		l := b.buf[x]
+		return l.i > i || (l.i == i && l.j >= j)
+	})
+}
+
+// Add asserts the existence of a link from node i to node j. The link is
+// buffered, and the buffer is flushed into the tree if it's full.
+func (b *BufferedK2Tree) Add(i, j int) error {
+	err := checkNodes(i, j)
+	if err != nil {
+		return err
+	}
+	if b.tree.Contains(i, j) {
+		return nil
+	}
+	x := b.search(i, j)
+	if x < len(b.buf) && b.buf[x] == (link{i, j}) {
+		return nil
+	}
+	b.buf = append(b.buf, link{})
+	copy(b.buf[x+1:], b.buf[x:])
+	b.buf[x] = link{i, j}
+	if len(b.buf) >= b.size {
+		return b.Flush()
+	}
+	return nil
+}
+
+// Contains returns whether there is a link from node i to node j.
+func (b *BufferedK2Tree) Contains(i, j int) bool {
+	x := b.search(i, j)
+	if x < len(b.buf) && b.buf[x] == (link{i, j}) {
+		return true
+	}
+	return b.tree.Contains(i, j)
+}
+
+// From returns the nodes that node i links to, in order.
+func (b *BufferedK2Tree) From(i int) []int {
+	var buffered []int
+	for x := b.search(i, 0); x < len(b.buf) && b.buf[x].i == i; x++ {
+		buffered = append(buffered, b.buf[x].j)
+	}
+	return mergeInts(b.tree.From(i).ExtractAll(), buffered)
+}
+
+// To returns the nodes that link to node j, in order.
+func (b *BufferedK2Tree) To(j int) []int {
+	var buffered []int
+	for _, l := range b.buf {
+		if l.j == j {
+			buffered = append(buffered, l.i)
+		}
+	}
+	return mergeInts(b.tree.To(j).ExtractAll(), buffered)
+}
+
+// Buffered returns the number of links waiting to be flushed into the tree.
+func (b *BufferedK2Tree) Buffered() int {
+	return len(b.buf)
+}
+
+// Flush merges the buffered links into the tree with a single AddBatch.
+func (b *BufferedK2Tree) Flush() error {
+	if len(b.buf) == 0 {
+		return nil
+	}
+	pending := make([]link, len(b.buf))
+	copy(pending, b.buf)
+	_, err := b.tree.addLinks(pending)
+	if err != nil {
+		return err
+	}
+	b.buf = b.buf[:0]
+	return nil
+}
+
+// mergeInts merges two sorted lists of distinct ints.
+func mergeInts(a, b []int) []int {
+	if len(b) == 0 {
+		return a
+	}
+	out := make([]int, 0, len(a)+len(b))
+	for len(a) > 0 && len(b) > 0 {
+		if a[0] < b[0] {
+			out = append(out, a[0])
+			a = a[1:]
+		} else {
+			out = append(out, b[0])
+			b = b[1:]
+		}
+	}
+	out = append(out, a...)
+	return append(out, b...)
+}
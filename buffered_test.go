@@ -0,0 +1,61 @@
+package k2tree
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestBufferedMatchesTree(t *testing.T) {
+	for _, config := range []Config{DefaultConfig, FourFourConfig} {
+		b, err := NewBufferedWithConfig(config, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		k, err := NewWithConfig(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for x := 0; x < 2050; x++ {
+			i, j := rand.Intn(3000), rand.Intn(300)
+			if x > 1000 {
+				// Grow the tree between flushes.
+				i, j = rand.Intn(20000), rand.Intn(20000)
+			}
+			err := b.Add(i, j)
+			if err != nil {
+				t.Fatal(err)
+			}
+			k.Add(i, j)
+			if !b.Contains(i, j) {
+				t.Fatalf("missing %d, %d after Add", i, j)
+			}
+		}
+		if b.Buffered() == 0 {
+			t.Fatal("expected some links to still be buffered")
+		}
+		check := func() {
+			for x := 0; x < 300; x++ {
+				n := rand.Intn(3000)
+				if got, expected := b.From(n), k.From(n).ExtractAll(); !reflect.DeepEqual(got, expected) {
+					t.Fatalf("From(%d) = %v, expected %v", n, got, expected)
+				}
+				if got, expected := b.To(n), k.To(n).ExtractAll(); !reflect.DeepEqual(got, expected) {
+					t.Fatalf("To(%d) = %v, expected %v", n, got, expected)
+				}
+			}
+		}
+		check()
+		err = b.Flush()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b.Buffered() != 0 {
+			t.Fatal("buffer not empty after Flush")
+		}
+		check()
+		if got, expected := b.tree.links(), k.links(); !reflect.DeepEqual(got, expected) {
+			t.Fatalf("flushed tree has %d links, expected %d", len(got), len(expected))
+		}
+	}
+}
@@ -147,10 +147,16 @@ func (b *byteArray) insertFour(at int) error {
 		off++
 	}
 	inbyte = inbyte << 4
-	for i := off; i < b.bytes.Len(); i++ {
-		t := b.bytes.Get(i)
-		b.bytes.Set(i, t>>4|inbyte)
-		inbyte = t << 4
+	if seg, ok := b.bytes.(bytearray.Segmented); ok {
+		seg.Segments(off, func(s []byte) {
+			inbyte = insertFourBits(s, inbyte)
+		})
+	} else {
+		for i := off; i < b.bytes.Len(); i++ {
+			t := b.bytes.Get(i)
+			b.bytes.Set(i, t>>4|inbyte)
+			inbyte = t << 4
+		}
 	}
 	if inbyte != 0x00 {
 		panic("Overshot")
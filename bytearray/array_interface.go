@@ -11,8 +11,18 @@ type ByteArray interface {
 	Copy(from, to, n int)
 }
 
+// Segmented is implemented by ByteArrays that can expose their contents
+// directly, as a run of slices.
+type Segmented interface {
+	// Segments calls fn with consecutive slices of the array, in order,
+	// covering the bytes from idx to the end. Writes to the slices are
+	// writes to the array.
+	Segments(idx int, fn func(b []byte))
+}
+
 var _ ByteArray = &SpilloverArray{}
 var _ ByteArray = &SliceArray{}
+var _ Segmented = &SliceArray{}
 
 type SliceArray struct {
 	bytes []byte
@@ -50,3 +60,9 @@ func (s *SliceArray) PopCount(start, end int) uint64 {
 func (s *SliceArray) Copy(from, to, n int) {
 	copy(s.bytes[to:], s.bytes[from:from+n])
 }
+
+func (s *SliceArray) Segments(idx int, fn func(b []byte)) {
+	if idx < len(s.bytes) {
+		fn(s.bytes[idx:])
+	}
+}
@@ -3,6 +3,7 @@ package bytearray
 import (
 	"bufio"
 	"io"
+	"math/bits"
 	"math/rand"
 	"os"
 	"strconv"
@@ -56,6 +57,16 @@ func TestCompareBaselineFront(t *testing.T) {
 	testCompareBaseline(t, vec)
 }
 
+func TestCompareBaselineFrontGrow(t *testing.T) {
+	vec := NewFrontSlice(3)
+	testCompareBaseline(t, vec)
+}
+
+func TestCompareBaselineSpillover(t *testing.T) {
+	vec := NewSpillover(128, 0.8, 0.3, true)
+	testCompareBaseline(t, vec)
+}
+
 func TestCompareBaselineInt16(t *testing.T) {
 	vec := NewInt16Index(NewSlice())
 	testCompareBaseline(t, vec)
@@ -90,3 +101,49 @@ func insertTestVector() []int {
 
 	return insertTestVectorCache
 }
+
+func TestSegments(t *testing.T) {
+	arrays := map[string]ByteArray{
+		"Slice":      NewSlice(),
+		"Front":      NewFrontSlice(1024),
+		"Paged":      NewPaged(128, 0.8, 0.3),
+		"Spillover":  NewSpillover(512, 0.75, 0.5, true),
+		"Int16":      NewInt16Index(NewSlice()),
+		"Int16Paged": NewInt16Index(NewPaged(128, 0.8, 0.3)),
+	}
+	for name, vec := range arrays {
+		for i := 0; i < 5000; i++ {
+			b := byte(i)
+			vec.Insert(rand.Intn(vec.Len()+1), []byte{b})
+		}
+		for i := 0; i < 20; i++ {
+			idx := rand.Intn(vec.Len() + 1)
+			var got []byte
+			vec.(Segmented).Segments(idx, func(b []byte) {
+				got = append(got, b...)
+				for x := range b {
+					b[x] = ^b[x]
+				}
+			})
+			if len(got) != vec.Len()-idx {
+				t.Fatalf("%s: segments from %d covered %d bytes, expected %d", name, idx, len(got), vec.Len()-idx)
+			}
+			for x, b := range got {
+				if vec.Get(idx+x) != ^b {
+					t.Fatalf("%s: segment byte %d from %d wasn't written through", name, x, idx)
+				}
+			}
+			if vec.PopCount(0, vec.Len()) != countAll(vec) {
+				t.Fatalf("%s: popcount is stale after writing to segments", name)
+			}
+		}
+	}
+}
+
+func countAll(vec ByteArray) uint64 {
+	var n uint64
+	for i := 0; i < vec.Len(); i++ {
+		n += uint64(bits.OnesCount8(vec.Get(i)))
+	}
+	return n
+}
@@ -3,6 +3,7 @@ package bytearray
 import "github.com/tmthrgd/go-popcount"
 
 var _ ByteArray = &FrontSlice{}
+var _ Segmented = &FrontSlice{}
 
 type FrontSlice struct {
 	bytes []byte
@@ -34,7 +35,7 @@ func (f *FrontSlice) Insert(idx int, b []byte) {
 		newbytes := make([]byte, oldlen*2)
 		copy(newbytes[oldlen:], f.bytes)
 		f.bytes = newbytes
-		f.off = oldlen
+		f.off += oldlen
 		f.Insert(idx, b)
 		return
 	}
@@ -50,3 +51,9 @@ func (f *FrontSlice) PopCount(start, end int) uint64 {
 func (f *FrontSlice) Copy(from, to, n int) {
 	copy(f.bytes[f.off+to:], f.bytes[f.off+from:f.off+from+n])
 }
+
+func (f *FrontSlice) Segments(idx int, fn func(b []byte)) {
+	if idx < f.Len() {
+		fn(f.bytes[f.off+idx:])
+	}
+}
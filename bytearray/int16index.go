@@ -10,6 +10,7 @@ type Int16Index struct {
 }
 
 var _ ByteArray = (*Int16Index)(nil)
+var _ Segmented = (*Int16Index)(nil)
 
 const int16Max = 1 << 13
 
@@ -144,3 +145,21 @@ func (ix *Int16Index) Copy(from, to, n int) {
 	// Completely recalculate starting at "to"
 	ix.adjustBig(to)
 }
+
+func (ix *Int16Index) Segments(idx int, fn func(b []byte)) {
+	if seg, ok := ix.bytes.(Segmented); ok {
+		seg.Segments(idx, fn)
+	} else if idx < ix.bytes.Len() {
+		// Go through a copy.
+		buf := make([]byte, ix.bytes.Len()-idx)
+		for i := range buf {
+			buf[i] = ix.bytes.Get(idx + i)
+		}
+		fn(buf)
+		for i, b := range buf {
+			ix.bytes.Set(idx+i, b)
+		}
+	}
+	// The writes bypassed the counts.
+	ix.adjustBig(idx)
+}
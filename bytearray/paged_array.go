@@ -19,6 +19,8 @@ type PagedArray struct {
 	low         int
 }
 
+var _ Segmented = &PagedArray{}
+
 func NewPaged(pagesize int, highwaterPercentage, lowUtilization float64) *PagedArray {
 	if highwaterPercentage < lowUtilization {
 		panic("User error: highwaterPercentage is higher than lowUtilization")
@@ -262,3 +264,16 @@ func (p *PagedArray) Copy(from int, to int, n int) {
 
 	bufPool.Put(buf)
 }
+
+func (p *PagedArray) Segments(idx int, fn func(b []byte)) {
+	if idx >= p.length {
+		return
+	}
+	startl, startoff := p.findOffset(idx)
+	for l := startl; l < p.levels(); l++ {
+		if startoff < p.levelLength[l] {
+			fn(p.pages[l][startoff:p.levelLength[l]])
+		}
+		startoff = 0
+	}
+}
@@ -27,6 +27,8 @@ func (a *SpilloverArray) stats() string {
 	return fmt.Sprintf("%#v", b)
 }
 
+var _ Segmented = &SpilloverArray{}
+
 func NewSpillover(pagesize int, highwaterPercentage, lowUtilization float64, multiplier bool) *SpilloverArray {
 	if highwaterPercentage < lowUtilization {
 		panic("User error: highwaterPercentage is higher than lowUtilization")
@@ -330,3 +332,18 @@ func (a *SpilloverArray) Copy(from, to, n int) {
 
 	bufPool.Put(buf)
 }
+
+func (a *SpilloverArray) Segments(idx int, fn func(b []byte)) {
+	if idx >= a.length {
+		return
+	}
+	startl, startoff := a.findOffset(idx)
+	for l := startl; l < a.levels(); l++ {
+		if l != startl {
+			startoff = a.levelOff[l]
+		}
+		if end := a.levelStart(l + 1); startoff < end {
+			fn(a.bytes[startoff:end])
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package k2tree
+
+import (
+	"fmt"
+	"sync"
+)
+
+// ChangeKind is the kind of a Change.
+type ChangeKind int
+
+const (
+	// LinkAdded is a link that wasn't in the tree being added to it.
+	LinkAdded ChangeKind = iota + 1
+	// LinkRemoved is a link that was in the tree being removed from it.
+	LinkRemoved
+	// TreeGrown is the tree adding levels on top to hold a link beyond its
+	// extent, or its first levels to hold its first link.
+	TreeGrown
+	// TreeCompacted is the tree being rebuilt by Compact, which may drop
+	// levels from the top.
+	TreeCompacted
+)
+
+func (c ChangeKind) String() string {
+	switch c {
+	case LinkAdded:
+		return "LinkAdded"
+	case LinkRemoved:
+		return "LinkRemoved"
+	case TreeGrown:
+		return "TreeGrown"
+	case TreeCompacted:
+		return "TreeCompacted"
+	}
+	return fmt.Sprintf("ChangeKind(%d)", int(c))
+}
+
+// Change is a change made to a K2Tree.
+type Change struct {
+	Kind ChangeKind
+	// From and To are the nodes of the link, for LinkAdded and LinkRemoved.
+	From int
+	To   int
+	// Levels is the number of levels in the tree after a TreeGrown or
+	// TreeCompacted.
+	Levels int
+}
+
+// observer is a func registered with OnChange. stop is set for
+// subscriptions, and ends them.
+type observer struct {
+	fn   func(Change)
+	stop func()
+}
+
+// observers holds the observers of a tree, in the order they were
+// registered.
+type observers struct {
+	mu   sync.Mutex
+	list []*observer
+}
+
+// OnChange registers fn to be called with every change made to the tree,
+// and returns a func that unregisters it.
+//
+// fn is called on the goroutine that made the change, once it's made, with
+// the changes in the order they were made, and mustn't change the tree. An
+// Add reports a LinkAdded only if the link is new, after the TreeGrown of any
+// levels added to hold it. AddBatch reports the new links once they've all
+// been merged in, and a Txn reports its changes once Commit has applied
+// them. The changes replayed from the log when a persistent tree is opened
+// aren't reported.
+//
+// OnChange mustn't race with changes to the tree, but the func it returns
+// may be called from any goroutine.
+func (k *K2Tree) OnChange(fn func(Change)) (cancel func()) {
+	return k.observe(&observer{fn: fn})
+}
+
+// Subscribe returns a channel that receives every change made to the tree,
+// as OnChange reports them, and a func that ends the subscription and closes
+// the channel. Close ends every subscription to the tree.
+//
+// The channel buffers size changes. Once it's full, the change that doesn't
+// fit blocks the goroutine making it until the subscriber receives it or
+// ends the subscription: no change is ever dropped, so a subscriber that
+// falls behind holds up the writer to the tree. A subscriber that stops
+// receiving must end its subscription, or the next change to the tree will
+// block forever.
+func (k *K2Tree) Subscribe(size int) (<-chan Change, func()) {
+	s := &subscription{
+		ch:   make(chan Change, size),
+		done: make(chan struct{}),
+	}
+	return s.ch, k.observe(&observer{fn: s.send, stop: s.stop})
+}
+
+// observe registers o, and returns the func that unregisters it.
+func (k *K2Tree) observe(o *observer) func() {
+	if k.observers == nil {
+		k.observers = &observers{}
+	}
+	obs := k.observers
+	obs.mu.Lock()
+	obs.list = append(obs.list, o)
+	obs.mu.Unlock()
+	return func() {
+		obs.mu.Lock()
+		for x, other := range obs.list {
+			if other == o {
+				obs.list = append(obs.list[:x:x], obs.list[x+1:]...)
+				break
+			}
+		}
+		obs.mu.Unlock()
+		if o.stop != nil {
+			o.stop()
+		}
+	}
+}
+
+// observed returns whether anything is registered to hear of changes to the
+// tree, so that changes needn't be worked out for nobody.
+func (k *K2Tree) observed() bool {
+	if k.observers == nil {
+		return false
+	}
+	k.observers.mu.Lock()
+	defer k.observers.mu.Unlock()
+	return len(k.observers.list) != 0
+}
+
+// notify reports changes to the observers of the tree.
+func (k *K2Tree) notify(changes ...Change) {
+	if k.observers == nil || len(changes) == 0 {
+		return
+	}
+	k.observers.mu.Lock()
+	list := k.observers.list
+	k.observers.mu.Unlock()
+	for _, c := range changes {
+		for _, o := range list {
+			o.fn(c)
+		}
+	}
+}
+
+// notifyGrown reports a TreeGrown if the tree has more levels than it had
+// before.
+func (k *K2Tree) notifyGrown(before int) {
+	if k.levels > before {
+		k.notify(Change{Kind: TreeGrown, Levels: k.levels})
+	}
+}
+
+// endSubscriptions unregisters the subscriptions to the tree, closing their
+// channels.
+func (k *K2Tree) endSubscriptions() {
+	if k.observers == nil {
+		return
+	}
+	k.observers.mu.Lock()
+	var subs, rest []*observer
+	for _, o := range k.observers.list {
+		if o.stop != nil {
+			subs = append(subs, o)
+		} else {
+			rest = append(rest, o)
+		}
+	}
+	k.observers.list = rest
+	k.observers.mu.Unlock()
+	for _, o := range subs {
+		o.stop()
+	}
+}
+
+// subscription delivers changes to the channel of a Subscribe.
+type subscription struct {
+	ch   chan Change
+	done chan struct{}
+	// mu is held while a change is sent, so that the channel isn't closed
+	// under it.
+	mu     sync.Mutex
+	closed bool
+	once   sync.Once
+}
+
+// send delivers c, waiting for room in the channel unless the subscription
+// ends first.
+func (s *subscription) send(c Change) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.ch <- c:
+	case <-s.done:
+	}
+}
+
+// stop ends the subscription, releasing a send that's waiting on it, and
+// closes the channel.
+func (s *subscription) stop() {
+	s.once.Do(func() {
+		close(s.done)
+		s.mu.Lock()
+		s.closed = true
+		close(s.ch)
+		s.mu.Unlock()
+	})
+}
@@ -0,0 +1,129 @@
+package k2tree
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestOnChange(t *testing.T) {
+	k, err := NewWithConfig(FourFourConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []Change
+	cancel := k.OnChange(func(c Change) {
+		got = append(got, c)
+	})
+	grown := func() Change {
+		return Change{Kind: TreeGrown, Levels: k.levels}
+	}
+	expect := func(what string, expected ...Change) {
+		t.Helper()
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("%s: expected %v, got %v", what, expected, got)
+		}
+		got = nil
+	}
+
+	k.Add(3, 5)
+	expect("first Add", grown(), Change{Kind: LinkAdded, From: 3, To: 5})
+	k.Add(3, 5)
+	expect("duplicate Add")
+	k.Add(40, 2)
+	expect("growing Add", grown(), Change{Kind: LinkAdded, From: 40, To: 2})
+	k.Remove(3, 5)
+	k.Remove(3, 5)
+	expect("Remove", Change{Kind: LinkRemoved, From: 3, To: 5})
+	k.AddBatch([]Edge{{1, 1}, {40, 2}, {1, 1}})
+	expect("AddBatch", Change{Kind: LinkAdded, From: 1, To: 1})
+
+	txn := k.Begin()
+	txn.Add(300, 0)
+	txn.Remove(1, 1)
+	if got != nil {
+		t.Error("a Txn reported changes before Commit")
+	}
+	err = txn.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect("Commit", grown(), Change{Kind: LinkAdded, From: 300, To: 0}, Change{Kind: LinkRemoved, From: 1, To: 1})
+
+	k.Remove(300, 0)
+	got = nil
+	levels := k.levels
+	k.Compact()
+	if k.levels >= levels {
+		t.Error("expected Compact to drop levels")
+	}
+	expect("Compact", Change{Kind: TreeCompacted, Levels: k.levels})
+
+	cancel()
+	k.Add(7, 7)
+	expect("Add after cancel")
+}
+
+func TestSubscribe(t *testing.T) {
+	k, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes, cancel := k.Subscribe(3)
+	k.Add(1, 1)
+	k.Add(1, 2)
+	// The buffer is full, so the next change waits for the subscriber.
+	done := make(chan struct{})
+	go func() {
+		k.Add(1, 3)
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("Add didn't wait for the full subscription")
+	case <-time.After(50 * time.Millisecond):
+	}
+	var got []Change
+	for len(got) < 4 {
+		got = append(got, <-changes)
+	}
+	<-done
+	expected := []Change{
+		{Kind: TreeGrown, Levels: k.levels},
+		{Kind: LinkAdded, From: 1, To: 1},
+		{Kind: LinkAdded, From: 1, To: 2},
+		{Kind: LinkAdded, From: 1, To: 3},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	// Ending the subscription releases a blocked writer and closes the
+	// channel.
+	k.Add(2, 1)
+	k.Add(2, 2)
+	k.Add(2, 3)
+	done = make(chan struct{})
+	go func() {
+		k.Add(2, 4)
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	<-done
+	n := 0
+	for range changes {
+		n++
+	}
+	if n != 3 {
+		t.Errorf("expected the 3 buffered changes, got %d", n)
+	}
+	cancel()
+	k.Add(2, 5)
+
+	changes, _ = k.Subscribe(0)
+	k.Close()
+	if _, ok := <-changes; ok {
+		t.Error("Close didn't end the subscription")
+	}
+}
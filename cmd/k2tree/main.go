@@ -0,0 +1,82 @@
+// Command k2tree inspects and maintains the pagefiles of persistent k2trees.
+//
+// Usage:
+//
+//	k2tree fsck FILE...
+//	k2tree upgrade FILE...
+//
+// fsck checks each file with k2tree.Verify, and exits with status 1 if any
+// of them is corrupt.
+//
+// upgrade rewrites each file into the current format with k2tree.Upgrade.
+// The files mustn't be open elsewhere.
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/barakmich/k2tree"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: k2tree fsck FILE...")
+	fmt.Fprintln(os.Stderr, "       k2tree upgrade FILE...")
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	args := os.Args[2:]
+	switch os.Args[1] {
+	case "fsck":
+		if len(args) == 0 {
+			usage()
+		}
+		os.Exit(fsck(args))
+	case "upgrade":
+		if len(args) == 0 {
+			usage()
+		}
+		os.Exit(upgrade(args))
+	default:
+		usage()
+	}
+}
+
+func fsck(paths []string) int {
+	status := 0
+	for _, path := range paths {
+		err := k2tree.Verify(path)
+		if err == nil {
+			fmt.Printf("%s: ok\n", path)
+			continue
+		}
+		status = 1
+		if e, ok := err.(*k2tree.CorruptError); ok {
+			fmt.Printf("%s: corrupt\n", path)
+			for _, p := range e.Problems {
+				fmt.Printf("\t%s\n", p)
+			}
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+	}
+	return status
+}
+
+func upgrade(paths []string) int {
+	status := 0
+	for _, path := range paths {
+		err := k2tree.Upgrade(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			status = 1
+			continue
+		}
+		fmt.Printf("%s: ok\n", path)
+	}
+	return status
+}
@@ -0,0 +1,26 @@
+package k2tree
+
+// BitArrayType is a bitarray the package's tests run against, exported for
+// the conformance suite in bitarraytest, which imports this package and so can
+// only be run from outside it.
+type BitArrayType struct {
+	Name   string
+	Create func() BitArray
+}
+
+// BitArrayTypes returns every bitarray under test, along with a BitArray as
+// a user would write it.
+func BitArrayTypes() []BitArrayType {
+	var out []BitArrayType
+	for _, ba := range append(testBitArrayTypes, debugBitArrayTypes...) {
+		create := ba.create
+		out = append(out, BitArrayType{
+			Name:   ba.name,
+			Create: func() BitArray { return create() },
+		})
+	}
+	return append(out, BitArrayType{
+		Name:   "User",
+		Create: func() BitArray { return &boolArray{} },
+	})
+}
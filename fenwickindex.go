@@ -0,0 +1,209 @@
+package k2tree
+
+import "fmt"
+
+// fenwickBlockBits is the default target number of bits counted by each
+// block of a fenwickIndex.
+const fenwickBlockBits = 1 << 12
+
+// fenwickIndex divides the array into blocks of roughly equal size and keeps
+// the length and the count of set bits of each block, each with a Fenwick
+// (binary indexed) tree over them. Finding the block holding an offset, rank
+// queries and updates on Set all take O(log n) in the number of blocks.
+//
+// Blocks move with their bits, so an Insert only grows the length of the
+// block it lands in; once a block is twice the target size it's split in
+// two and the trees are rebuilt in linear time.
+type fenwickIndex struct {
+	bits   bitarray
+	block  int
+	lens   []int
+	counts []int
+	// lenTree and countTree are 1-indexed; entry i holds the sum over the
+	// blocks (i - lowbit(i), i].
+	lenTree   []int
+	countTree []int
+}
+
+var _ bitarray = (*fenwickIndex)(nil)
+
+func newFenwickIndex(b bitarray, block int) *fenwickIndex {
+	if b.Len() != 0 {
+		panic("unimplemented")
+	}
+	if block <= 0 {
+		panic("block size must be positive")
+	}
+	f := &fenwickIndex{
+		bits:   b,
+		block:  block,
+		lens:   []int{0},
+		counts: []int{0},
+	}
+	f.rebuild()
+	return f
+}
+
+// Len returns the number of bits in the bitarray.
+func (f *fenwickIndex) Len() int {
+	return f.bits.Len()
+}
+
+// Set sets the bit at an index `at` to the value `val`.
+func (f *fenwickIndex) Set(at int, val bool) {
+	cur := f.bits.Get(at)
+	if cur == val {
+		return
+	}
+	f.bits.Set(at, val)
+	delta := -1
+	if val {
+		delta = 1
+	}
+	b, _ := f.locate(at)
+	f.counts[b] += delta
+	fenwickAdd(f.countTree, b, delta)
+}
+
+// Get returns the value stored at `at`.
+func (f *fenwickIndex) Get(at int) bool {
+	return f.bits.Get(at)
+}
+
+// Count returns the number of set bits in the interval [from, to).
+func (f *fenwickIndex) Count(from int, to int) int {
+	if from > to {
+		from, to = to, from
+	}
+	if to-from <= f.block {
+		return f.bits.Count(from, to)
+	}
+	return f.zeroCount(to) - f.zeroCount(from)
+}
+
+// zeroCount computes the count from zero to the given value.
+func (f *fenwickIndex) zeroCount(to int) int {
+	b, start := f.locate(to)
+	total := fenwickPrefix(f.countTree, b)
+	if to == start {
+		return total
+	}
+	end := start + f.lens[b]
+	if to-start > f.lens[b]/2 {
+		return total + f.counts[b] - f.bits.Count(to, end)
+	}
+	return total + f.bits.Count(start, to)
+}
+
+// locate returns the block holding the bit at `at`, and the offset at which
+// that block starts. An offset at the end of the array belongs to the last
+// block.
+func (f *fenwickIndex) locate(at int) (block int, start int) {
+	// Descend the tree for the number of blocks that end at or before `at`.
+	pos := 0
+	step := 1
+	for step*2 < len(f.lenTree) {
+		step *= 2
+	}
+	for ; step > 0; step >>= 1 {
+		next := pos + step
+		if next < len(f.lenTree) && start+f.lenTree[next] <= at {
+			pos = next
+			start += f.lenTree[next]
+		}
+	}
+	if pos == len(f.lens) {
+		pos--
+		start -= f.lens[pos]
+	}
+	return pos, start
+}
+
+// Total returns the total number of set bits.
+func (f *fenwickIndex) Total() int {
+	return f.bits.Total()
+}
+
+// Insert extends the bitarray by `n` bits. The bits are zeroed
+// and start at index `at`. Example:
+// Initial string: 11101
+// Insert(3, 2)
+// Resulting string: 11000101
+func (f *fenwickIndex) Insert(n int, at int) error {
+	if n == 0 {
+		return nil
+	}
+	b, start := f.locate(at)
+	err := f.bits.Insert(n, at)
+	if err != nil {
+		return err
+	}
+	f.lens[b] += n
+	if f.lens[b] < 2*f.block {
+		fenwickAdd(f.lenTree, b, n)
+		return nil
+	}
+	f.split(b, start)
+	return nil
+}
+
+// split breaks the block b, starting at `start`, into pieces of the target
+// size and rebuilds the trees.
+func (f *fenwickIndex) split(b int, start int) {
+	pieces := f.lens[b] / f.block
+	lens := make([]int, pieces)
+	counts := make([]int, pieces)
+	for i := range lens {
+		lens[i] = f.block
+		counts[i] = f.bits.Count(start+i*f.block, start+(i+1)*f.block)
+	}
+	lens[pieces-1] = f.lens[b] - (pieces-1)*f.block
+	counts[pieces-1] = f.counts[b] - f.bits.Count(start, start+(pieces-1)*f.block)
+
+	f.lens = append(f.lens[:b], append(lens, f.lens[b+1:]...)...)
+	f.counts = append(f.counts[:b], append(counts, f.counts[b+1:]...)...)
+	f.rebuild()
+}
+
+// rebuild recomputes both Fenwick trees from the block lengths and counts.
+func (f *fenwickIndex) rebuild() {
+	f.lenTree = fenwickBuild(f.lenTree, f.lens)
+	f.countTree = fenwickBuild(f.countTree, f.counts)
+}
+
+// fenwickBuild builds the Fenwick tree over vals in linear time, reusing the
+// storage of tree if it's large enough.
+func fenwickBuild(tree []int, vals []int) []int {
+	if cap(tree) < len(vals)+1 {
+		tree = make([]int, len(vals)+1, 2*len(vals)+1)
+	}
+	tree = tree[:len(vals)+1]
+	tree[0] = 0
+	copy(tree[1:], vals)
+	for i := 1; i < len(tree); i++ {
+		if j := i + (i & -i); j < len(tree) {
+			tree[j] += tree[i]
+		}
+	}
+	return tree
+}
+
+// fenwickAdd adds delta to the value at index i.
+func fenwickAdd(tree []int, i int, delta int) {
+	for i++; i < len(tree); i += i & -i {
+		tree[i] += delta
+	}
+}
+
+// fenwickPrefix returns the sum of the first n values.
+func fenwickPrefix(tree []int, n int) int {
+	total := 0
+	for i := n; i > 0; i -= i & -i {
+		total += tree[i]
+	}
+	return total
+}
+
+func (f *fenwickIndex) debug() string {
+	return fmt.Sprintf("FenwickIndex:\n internal: %s\nlens:%#v\ncounts:%#v", f.bits.debug(), f.lens, f.counts)
+}
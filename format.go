@@ -0,0 +1,147 @@
+package k2tree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// currentVersion is the version of the pagefile format that magicHeader
+// identifies, and the only one that's opened.
+const currentVersion = 2
+
+// ErrVersionMismatch is returned when opening a pagefile written in a format
+// other than the current one. Files in an older format can be brought up to
+// date with Upgrade.
+type ErrVersionMismatch struct {
+	// Found is the format version of the file.
+	Found int
+}
+
+func (e *ErrVersionMismatch) Error() string {
+	if e.Found < currentVersion {
+		return fmt.Sprintf("k2tree: pagefile is format version %d, not %d; it needs an Upgrade", e.Found, currentVersion)
+	}
+	return fmt.Sprintf("k2tree: pagefile is format version %d, newer than this package's %d", e.Found, currentVersion)
+}
+
+// format is a version of the pagefile format.
+type format struct {
+	version int
+	// upgrade rewrites a locked file of this version, with header h, into
+	// the next version, except for the magic header. It must leave a file
+	// that's still valid in this version, should it be interrupted.
+	upgrade func(f *os.File, h header) error
+}
+
+// formats are every version of the pagefile format, oldest first. A version
+// is never changed once released: a new one is added, along with an upgrade
+// to it from the one before.
+var formats = []format{
+	// Version 1 had no checkpoints or page checksums, and left the header
+	// after its first fields unused.
+	{version: 1, upgrade: clearReserve},
+	{version: currentVersion},
+}
+
+// magicFor returns the magic header of a version of the format.
+func magicFor(version int) [8]byte {
+	var m [8]byte
+	copy(m[:], fmt.Sprintf("K2BPv%d", version))
+	return m
+}
+
+// formatVersion returns the version of the format that magic identifies,
+// which may be one this package doesn't know of.
+func formatVersion(magic [8]byte) (int, error) {
+	if !bytes.HasPrefix(magic[:], []byte("K2BPv")) {
+		return 0, errors.New("incompatible magic header")
+	}
+	digits := bytes.TrimRight(magic[5:], "\x00")
+	v, err := strconv.Atoi(string(digits))
+	if err != nil || v < 1 || magicFor(v) != magic {
+		return 0, errors.New("incompatible magic header")
+	}
+	return v, nil
+}
+
+// checkVersion returns an error if magic isn't the current version.
+func checkVersion(magic [8]byte) error {
+	v, err := formatVersion(magic)
+	if err != nil {
+		return err
+	}
+	if v != currentVersion {
+		return &ErrVersionMismatch{Found: v}
+	}
+	return nil
+}
+
+// Upgrade rewrites the pagefile at path, in place, from the format version
+// it was written in to the current one. Its log is unchanged. Upgrade does
+// nothing to a file that's already current; it returns an
+// *ErrVersionMismatch for files newer than this package, and ErrLocked if
+// the file is open elsewhere.
+//
+// Each step between versions leaves a file that's valid in one version or
+// the next, so an interrupted Upgrade can be run again.
+func Upgrade(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	err = lockFile(f, true, false)
+	if err != nil {
+		return err
+	}
+	for {
+		var h header
+		_, err = f.Seek(0, 0)
+		if err == nil {
+			err = binary.Read(f, binary.BigEndian, &h)
+		}
+		if err != nil {
+			return err
+		}
+		v, err := formatVersion(h.Magic)
+		if err != nil {
+			return err
+		}
+		if v == currentVersion {
+			return nil
+		}
+		if v > currentVersion {
+			return &ErrVersionMismatch{Found: v}
+		}
+		err = formats[v-1].upgrade(f, h)
+		if err != nil {
+			return err
+		}
+		err = f.Sync()
+		if err != nil {
+			return err
+		}
+		magic := magicFor(v + 1)
+		_, err = f.WriteAt(magic[:], 0)
+		if err != nil {
+			return err
+		}
+		err = f.Sync()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// clearReserve upgrades a version 1 file by zeroing the part of the header
+// where the root slots and the free list now live, so that nothing left there
+// is taken for a checkpoint. The pages of a version 1 file hold nothing that
+// later versions read, so they're left unsealed; Vacuum reclaims them.
+func clearReserve(f *os.File, h header) error {
+	_, err := f.WriteAt(make([]byte, userMetadataOffset-blockSize), blockSize)
+	return err
+}
@@ -0,0 +1,91 @@
+package k2tree
+
+import (
+	"os"
+	"testing"
+)
+
+// setVersion rewrites the magic header of the file at path.
+func setVersion(t *testing.T, path string, version int) {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	magic := magicFor(version)
+	_, err = f.WriteAt(magic[:], 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectVersionMismatch(t *testing.T, err error, found int) {
+	t.Helper()
+	e, ok := err.(*ErrVersionMismatch)
+	if !ok {
+		t.Fatalf("expected an ErrVersionMismatch, got %v", err)
+	}
+	if e.Found != found {
+		t.Fatalf("expected to find version %d, got %d", found, e.Found)
+	}
+}
+
+func TestFormatVersion(t *testing.T) {
+	for _, v := range []int{1, 2, 10} {
+		got, err := formatVersion(magicFor(v))
+		if err != nil || got != v {
+			t.Errorf("expected version %d, got %d, %v", v, got, err)
+		}
+	}
+	for _, magic := range []string{"K2BPv", "K2BPv0", "K2BPvx", "K2BQv2", "K2BPv2\x00x"} {
+		var m [8]byte
+		copy(m[:], magic)
+		_, err := formatVersion(m)
+		if err == nil {
+			t.Errorf("expected an error for magic %q", magic)
+		}
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	path, cleanup := tempTreePath(t)
+	defer cleanup()
+	checkpointed(t, path)
+	// Version 1 had no checkpoints, so whatever is in its header is noise.
+	setVersion(t, path, 1)
+	_, err := Open(path, testOpenOptions)
+	expectVersionMismatch(t, err, 1)
+	expectVersionMismatch(t, Verify(path), 1)
+	err = Upgrade(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Verify(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := Open(path, testOpenOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkLinks(t, k, map[link]bool{})
+	err = k.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Upgrading a current file does nothing.
+	err = Upgrade(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpgradeFromTheFuture(t *testing.T) {
+	path, cleanup := tempTreePath(t)
+	defer cleanup()
+	checkpointed(t, path)
+	setVersion(t, path, currentVersion+1)
+	_, err := Open(path, testOpenOptions)
+	expectVersionMismatch(t, err, currentVersion+1)
+	expectVersionMismatch(t, Upgrade(path), currentVersion+1)
+}
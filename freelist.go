@@ -0,0 +1,188 @@
+package k2tree
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"sort"
+)
+
+/*
+Free List Layout:
+
+The free list lives in the PagefileDataReserve, at 12KiB:
+
+	Count (8B/int64)
+	Checksum (4B, CRC32C of the extents)
+	Reserved (4B)
+	Extents (Count x 16B, as Start (8B/int64), Pages (8B/int64))
+
+Extents are sorted and don't touch. The list is a record of which pages are
+free, not the source of truth: pages that the root slots point at are never
+treated as free, whatever the list says, and pages that are missing from it
+are only lost until the next Vacuum.
+*/
+
+const (
+	freeListOffset = 3 * blockSize
+	// maxFreeExtents is the most extents the free list can hold. Any more are
+	// dropped when it's written.
+	maxFreeExtents = (userMetadataOffset - freeListOffset - 16) / 16
+)
+
+// extent is a run of n pages starting at page start.
+type extent struct {
+	start int
+	n     int
+}
+
+func (e extent) end() int {
+	return e.start + e.n
+}
+
+// freeCount returns the number of free pages.
+func (s *pagefile) freeCount() int {
+	var n int
+	for _, e := range s.free {
+		n += e.n
+	}
+	return n
+}
+
+// allocPages returns the first page of the lowest run of n free pages,
+// growing the file for them if there isn't one.
+func (s *pagefile) allocPages(n int) (int, error) {
+	for x, e := range s.free {
+		if e.n < n {
+			continue
+		}
+		if e.n == n {
+			s.free = append(s.free[:x], s.free[x+1:]...)
+		} else {
+			s.free[x] = extent{e.start + n, e.n - n}
+		}
+		return e.start, nil
+	}
+	start := s.pages
+	return start, s.setPages(start + n)
+}
+
+// freePages marks the n pages starting at start as free. Free pages at the
+// end of the file are cut off it.
+func (s *pagefile) freePages(start, n int) error {
+	if n == 0 {
+		return nil
+	}
+	x := sort.Search(len(s.free), func(x int) bool {
+		return s.free[x].start > start
+	})
+	s.free = append(s.free, extent{})
+	copy(s.free[x+1:], s.free[x:])
+	s.free[x] = extent{start, n}
+	s.free = coalesce(s.free)
+	return s.trimFree()
+}
+
+// trimFree cuts the free pages at the end of the file off it.
+func (s *pagefile) trimFree() error {
+	if len(s.free) == 0 {
+		return nil
+	}
+	last := s.free[len(s.free)-1]
+	if last.end() < s.pages {
+		return nil
+	}
+	s.free = s.free[:len(s.free)-1]
+	return s.setPages(last.start)
+}
+
+// coalesce merges the touching extents of free, which must be sorted.
+func coalesce(free []extent) []extent {
+	if len(free) == 0 {
+		return free
+	}
+	out := free[:1]
+	for _, e := range free[1:] {
+		last := &out[len(out)-1]
+		if e.start <= last.end() {
+			if e.end() > last.end() {
+				last.n = e.end() - last.start
+			}
+			continue
+		}
+		out = append(out, e)
+	}
+	return out
+}
+
+// subtract returns free without the pages of used.
+func subtract(free []extent, used extent) []extent {
+	var out []extent
+	for _, e := range free {
+		if e.end() <= used.start || e.start >= used.end() {
+			out = append(out, e)
+			continue
+		}
+		if e.start < used.start {
+			out = append(out, extent{e.start, used.start - e.start})
+		}
+		if e.end() > used.end() {
+			out = append(out, extent{used.end(), e.end() - used.end()})
+		}
+	}
+	return out
+}
+
+// readFreeList loads the free list from the header, less any pages that
+// aren't in the file or that the valid root slots point at.
+func (s *pagefile) readFreeList() {
+	s.free = nil
+	free, _ := decodeFreeList(s.bytes[freeListOffset:userMetadataOffset])
+	for _, e := range free {
+		if e.start < s.pages {
+			s.free = append(s.free, extent{e.start, min(e.n, s.pages-e.start)})
+		}
+	}
+	for _, r := range s.roots() {
+		s.free = subtract(s.free, extent{int(r.StartPage), int(r.NumPages)})
+	}
+}
+
+// decodeFreeList returns the free list in region, or false if it's damaged.
+func decodeFreeList(region []byte) ([]extent, bool) {
+	n := int64(binary.BigEndian.Uint64(region))
+	if n < 0 || n > maxFreeExtents {
+		return nil, false
+	}
+	b := region[16 : 16+n*16]
+	if binary.BigEndian.Uint32(region[8:]) != crc32.Checksum(b, castagnoli) {
+		return nil, false
+	}
+	free := make([]extent, 0, n)
+	for ; len(b) != 0; b = b[16:] {
+		e := extent{
+			start: int(int64(binary.BigEndian.Uint64(b))),
+			n:     int(int64(binary.BigEndian.Uint64(b[8:]))),
+		}
+		if e.start < 0 || e.n <= 0 || (len(free) != 0 && e.start <= free[len(free)-1].end()) {
+			return nil, false
+		}
+		free = append(free, e)
+	}
+	return free, true
+}
+
+// writeFreeList stores the free list in the header.
+func (s *pagefile) writeFreeList() {
+	free := s.free
+	if len(free) > maxFreeExtents {
+		free = free[:maxFreeExtents]
+	}
+	region := s.bytes[freeListOffset:userMetadataOffset]
+	b := region[16 : 16+len(free)*16]
+	for x, e := range free {
+		binary.BigEndian.PutUint64(b[x*16:], uint64(int64(e.start)))
+		binary.BigEndian.PutUint64(b[x*16+8:], uint64(int64(e.n)))
+	}
+	binary.BigEndian.PutUint64(region, uint64(len(free)))
+	binary.BigEndian.PutUint32(region[8:], crc32.Checksum(b, castagnoli))
+}
@@ -0,0 +1,141 @@
+package k2tree
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestFreePages(t *testing.T) {
+	path, cleanup := tempTreePath(t)
+	defer cleanup()
+	pf, err := newPagefile(path, 2*blockSize, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pf.Close()
+	for _, n := range []int{2, 3, 1, 4} {
+		_, err := pf.allocPages(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if pf.pages != 10 {
+		t.Fatalf("expected 10 pages, got %d", pf.pages)
+	}
+	pf.freePages(0, 2)
+	pf.freePages(5, 1)
+	pf.freePages(2, 3)
+	if want := []extent{{0, 6}}; !reflect.DeepEqual(pf.free, want) {
+		t.Fatalf("expected free list %v, got %v", want, pf.free)
+	}
+	// The lowest run that fits is used.
+	start, err := pf.allocPages(4)
+	if err != nil || start != 0 {
+		t.Fatalf("expected to allocate at 0, got %d, %v", start, err)
+	}
+	start, err = pf.allocPages(3)
+	if err != nil || start != 10 {
+		t.Fatalf("expected to allocate at the end, got %d, %v", start, err)
+	}
+	// Freeing the end of the file shrinks it, along with any free pages
+	// before.
+	pf.freePages(6, 4)
+	pf.freePages(10, 3)
+	if pf.pages != 4 || len(pf.free) != 0 {
+		t.Fatalf("expected 4 pages and nothing free, got %d and %v", pf.pages, pf.free)
+	}
+	pf.freePages(1, 2)
+	pf.writeFreeList()
+	err = pf.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pf, err = openPagefile(path, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []extent{{1, 2}}; !reflect.DeepEqual(pf.free, want) {
+		t.Fatalf("expected free list %v after reopening, got %v", want, pf.free)
+	}
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fi.Size()
+}
+
+// vacuum vacuums k, and checks that its file holds only its checkpoint.
+func vacuum(t *testing.T, k *K2Tree, path string) {
+	t.Helper()
+	err := k.Vacuum()
+	if err != nil {
+		t.Fatal(err)
+	}
+	live := k.store.live
+	if live.StartPage != 0 || k.store.pf.pages != int(live.NumPages) || k.store.fallback.Seq != 0 {
+		t.Fatalf("expected only the checkpoint, at the front, got %+v in %d pages", live, k.store.pf.pages)
+	}
+	if want := int64(headerSize) + live.NumPages*int64(testOpenOptions.PageSize); fileSize(t, path) != want {
+		t.Errorf("expected a file of %d bytes, got %d", want, fileSize(t, path))
+	}
+}
+
+func TestVacuum(t *testing.T) {
+	path, cleanup := tempTreePath(t)
+	defer cleanup()
+	k, err := Open(path, testOpenOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := make(map[link]bool)
+	// Each checkpoint is bigger than the one before, so the last goes at the
+	// end of the file, and has to move through it to get to the front.
+	for _, n := range []int{200, 2000, 2000} {
+		addRandom(t, k, expected, n, 1000)
+		err = k.Checkpoint()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if k.store.live.StartPage == 0 {
+		t.Fatal("expected the last checkpoint to go after the others")
+	}
+	vacuum(t, k, path)
+	big := k.store.live.NumPages
+
+	for l := range expected {
+		if l.i > 100 || l.j > 100 {
+			k.Remove(l.i, l.j)
+			delete(expected, l)
+		}
+	}
+	err = k.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = k.Checkpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	vacuum(t, k, path)
+	if k.store.live.NumPages >= big {
+		t.Errorf("expected the file to shrink from %d pages, got %d", big, k.store.live.NumPages)
+	}
+
+	addRandom(t, k, expected, 10, 100)
+	crash(t, k)
+	err = Verify(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err = Open(path, testOpenOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer k.Close()
+	checkLinks(t, k, expected)
+}
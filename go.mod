@@ -6,4 +6,5 @@ require (
 	github.com/barakmich/mmap-go v0.0.0-20191027014435-dd5d4dc6d995
 	github.com/dustin/go-humanize v1.0.0
 	github.com/tmthrgd/go-popcount v0.0.0-20190904054823-afb1ace8b04f
+	golang.org/x/sys v0.0.0-20191026070338-33540a1f6037
 )
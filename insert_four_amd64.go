@@ -1,7 +1,18 @@
-// +build amd64,!gccgo,!appengine
+// +build amd64,!gccgo,!appengine,!purego
 
 package k2tree
 
+import (
+	"github.com/tmthrgd/go-popcount"
+	"golang.org/x/sys/cpu"
+)
+
+var useAVX2 = cpu.X86.HasAVX2
+
+// avx2MinBytes is the length below which the AVX2 routines aren't worth
+// their setup.
+const avx2MinBytes = 256
+
 // insertFourBits inserts the first four bits (0xF0) of in
 // the first nibble at position 0 in dest, and returns a byte with
 // the last four bits (0x0F) of dest shifted up.
@@ -9,8 +20,29 @@ func insertFourBits(dest []byte, in byte) byte {
 	if len(dest) == 0 {
 		return in & 0xF0
 	}
+	if useAVX2 && len(dest) >= avx2MinBytes {
+		out := dest[len(dest)-1] << 4
+		head := shiftFourBitsAVX2(&dest[0], uint64(len(dest)))
+		insertFourBitsAsm(&dest[0], head, in)
+		return out
+	}
 	return insertFourBitsAsm(&dest[0], uint64(len(dest)), in)
 }
 
+// countBytes returns the number of set bits in b.
+func countBytes(b []byte) uint64 {
+	if !useAVX2 || len(b) < avx2MinBytes {
+		return popcount.CountBytes(b)
+	}
+	n := len(b) &^ 63
+	return countBytesAVX2(&b[0], uint64(n)) + popcount.CountBytes(b[n:])
+}
+
 //go:noescape
 func insertFourBitsAsm(src *byte, len uint64, in byte) (ret byte)
+
+//go:noescape
+func shiftFourBitsAVX2(src *byte, len uint64) (head uint64)
+
+//go:noescape
+func countBytesAVX2(src *byte, len uint64) (ret uint64)
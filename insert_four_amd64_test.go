@@ -0,0 +1,49 @@
+// +build amd64,!gccgo,!appengine,!purego
+
+package k2tree
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"golang.org/x/sys/cpu"
+)
+
+// TestInsertFourDispatch runs insertFourBits and countBytes with useAVX2 both
+// off and on over the same inputs, so that the fallback is covered on
+// machines with AVX2 and the two paths are checked against each other.
+func TestInsertFourDispatch(t *testing.T) {
+	if !cpu.X86.HasAVX2 {
+		t.Skip("no AVX2 on this machine")
+	}
+	defer func(saved bool) { useAVX2 = saved }(useAVX2)
+	type result struct {
+		buf   []byte
+		out   byte
+		count uint64
+	}
+	run := func(avx2 bool, orig []byte, in byte) result {
+		useAVX2 = avx2
+		buf := make([]byte, len(orig))
+		copy(buf, orig)
+		count := countBytes(buf)
+		out := insertFourBits(buf, in)
+		return result{buf, out, count}
+	}
+	for i := 0; i < FuzzIterations; i++ {
+		in := byte(rand.Intn(256))
+		orig := generateByteString(avx2MinBytes - 8 + rand.Intn(4096))
+		generic := run(false, orig, in)
+		avx2 := run(true, orig, in)
+		if !bytes.Equal(generic.buf, avx2.buf) || generic.out != avx2.out {
+			t.Fatalf("insertFourBits of %d bytes with %#x: AVX2 and generic paths differ", len(orig), in)
+		}
+		if generic.count != avx2.count {
+			t.Fatalf("countBytes of %d bytes: AVX2 counted %d, generic %d", len(orig), avx2.count, generic.count)
+		}
+		if expected := insertFourBitsGo(orig, in); !bytes.Equal(orig, generic.buf) || expected != generic.out {
+			t.Fatalf("insertFourBits of %d bytes with %#x disagrees with insertFourBitsGo", len(orig), in)
+		}
+	}
+}
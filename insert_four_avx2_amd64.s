@@ -0,0 +1,131 @@
+// +build amd64,!gccgo,!appengine,!purego
+
+#include "textflag.h"
+
+// shiftFourBitsAVX2 shifts each byte of src down by a nibble, pulling in the
+// low nibble of the byte before it. It works from the end of src backwards,
+// 32 bytes at a time, so that each load still sees the original bytes. It
+// stops once 32 or fewer bytes remain at the front, which are left to the
+// caller, and returns their number.
+TEXT ·shiftFourBitsAVX2(SB), NOSPLIT, $0-24
+	MOVQ src+0(FP), SI
+	MOVQ len+8(FP), CX
+
+	MOVQ         $0x0F0F0F0F0F0F0F0F, AX
+	MOVQ         AX, X2
+	VPBROADCASTQ X2, Y2
+	VPSLLQ       $4, Y2, Y3
+
+	CMPQ CX, $65
+	JB   loop
+
+bigloop:
+	SUBQ    $64, CX
+	VMOVDQU 32(SI)(CX*1), Y0
+	VMOVDQU 31(SI)(CX*1), Y1
+	VMOVDQU (SI)(CX*1), Y4
+	VMOVDQU -1(SI)(CX*1), Y5
+	VPSRLQ  $4, Y0, Y0
+	VPSLLQ  $4, Y1, Y1
+	VPSRLQ  $4, Y4, Y4
+	VPSLLQ  $4, Y5, Y5
+	VPAND   Y2, Y0, Y0
+	VPAND   Y3, Y1, Y1
+	VPAND   Y2, Y4, Y4
+	VPAND   Y3, Y5, Y5
+	VPOR    Y1, Y0, Y0
+	VPOR    Y5, Y4, Y4
+	VMOVDQU Y0, 32(SI)(CX*1)
+	VMOVDQU Y4, (SI)(CX*1)
+
+	CMPQ CX, $65
+	JAE  bigloop
+
+loop:
+	CMPQ CX, $33
+	JB   done
+
+	SUBQ    $32, CX
+	VMOVDQU (SI)(CX*1), Y0
+	VMOVDQU -1(SI)(CX*1), Y1
+	VPSRLQ  $4, Y0, Y0
+	VPSLLQ  $4, Y1, Y1
+	VPAND   Y2, Y0, Y0
+	VPAND   Y3, Y1, Y1
+	VPOR    Y1, Y0, Y0
+	VMOVDQU Y0, (SI)(CX*1)
+	JMP     loop
+
+done:
+	VZEROUPPER
+	MOVQ CX, head+16(FP)
+	RET
+
+// Popcounts of the nibbles 0 through F, once for each lane.
+DATA nibbleCount<>+0x00(SB)/8, $0x0302020102010100
+DATA nibbleCount<>+0x08(SB)/8, $0x0403030203020201
+DATA nibbleCount<>+0x10(SB)/8, $0x0302020102010100
+DATA nibbleCount<>+0x18(SB)/8, $0x0403030203020201
+GLOBL nibbleCount<>(SB), RODATA|NOPTR, $32
+
+// countBytesAVX2 counts the set bits in src, whose length must be a multiple
+// of 64. Each byte is split into nibbles which are looked up in nibbleCount;
+// the per-byte counts are summed in two accumulators for up to 31 rounds
+// before they could overflow, then folded into 64-bit lanes.
+TEXT ·countBytesAVX2(SB), NOSPLIT, $0-24
+	MOVQ src+0(FP), SI
+	MOVQ len+8(FP), CX
+
+	VMOVDQU      nibbleCount<>(SB), Y4
+	MOVQ         $0x0F0F0F0F0F0F0F0F, AX
+	MOVQ         AX, X5
+	VPBROADCASTQ X5, Y5
+	VPXOR        Y6, Y6, Y6
+	VPXOR        Y7, Y7, Y7
+
+outer:
+	TESTQ CX, CX
+	JZ    sum
+	VPXOR Y3, Y3, Y3
+	VPXOR Y8, Y8, Y8
+	MOVQ  $31, DX
+
+inner:
+	VMOVDQU (SI), Y0
+	VMOVDQU 32(SI), Y9
+	VPSRLQ  $4, Y0, Y1
+	VPSRLQ  $4, Y9, Y10
+	VPAND   Y5, Y0, Y0
+	VPAND   Y5, Y1, Y1
+	VPAND   Y5, Y9, Y9
+	VPAND   Y5, Y10, Y10
+	VPSHUFB Y0, Y4, Y0
+	VPSHUFB Y1, Y4, Y1
+	VPSHUFB Y9, Y4, Y9
+	VPSHUFB Y10, Y4, Y10
+	VPADDB  Y0, Y1, Y0
+	VPADDB  Y9, Y10, Y9
+	VPADDB  Y0, Y3, Y3
+	VPADDB  Y9, Y8, Y8
+	ADDQ    $64, SI
+	SUBQ    $64, CX
+	JZ      fold
+	DECQ    DX
+	JNZ     inner
+
+fold:
+	VPSADBW Y7, Y3, Y3
+	VPSADBW Y7, Y8, Y8
+	VPADDQ  Y3, Y6, Y6
+	VPADDQ  Y8, Y6, Y6
+	JMP     outer
+
+sum:
+	VEXTRACTI128 $1, Y6, X0
+	VPADDQ       X0, X6, X0
+	VPSHUFD      $0x4E, X0, X1
+	VPADDQ       X1, X0, X0
+	MOVQ         X0, AX
+	VZEROUPPER
+	MOVQ         AX, ret+16(FP)
+	RET
@@ -1,5 +1,7 @@
 package k2tree
 
+import "encoding/binary"
+
 // insertFourBitsGo inserts the last top four bits (0xF0) of in
 // at the first nibble in position 0 in dest, and returns a byte
 // with the last four bits (0x0F) of dest shifted up.
@@ -12,3 +14,16 @@ func insertFourBitsGo(dest []byte, in byte) (out byte) {
 	}
 	return in
 }
+
+// insertFourBitsWord is insertFourBitsGo, shifting a 64-bit word at a time
+// and finishing the tail byte by byte.
+func insertFourBitsWord(dest []byte, in byte) (out byte) {
+	in = in & 0xF0
+	i := 0
+	for ; i+8 <= len(dest); i += 8 {
+		w := binary.BigEndian.Uint64(dest[i:])
+		binary.BigEndian.PutUint64(dest[i:], w>>4|uint64(in)<<56)
+		in = byte(w) << 4
+	}
+	return insertFourBitsGo(dest[i:], in)
+}
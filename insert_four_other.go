@@ -1,10 +1,17 @@
-// +build !amd64
+// +build !amd64 purego gccgo appengine
 
 package k2tree
 
+import "github.com/tmthrgd/go-popcount"
+
 // insertFourBits inserts the last four bits (0x0F) of in
 // at position 0 in dest, and returns a byte with the last four bits
 // (0x0F) of dest shifted up.
 func insertFourBits(dest []byte, in byte) (out byte) {
-	return insertFourBitsGo(dest, in)
+	return insertFourBitsWord(dest, in)
+}
+
+// countBytes returns the number of set bits in b.
+func countBytes(b []byte) uint64 {
+	return popcount.CountBytes(b)
 }
@@ -2,8 +2,11 @@ package k2tree
 
 import (
 	"bytes"
+	"math/bits"
 	"math/rand"
 	"testing"
+
+	"github.com/tmthrgd/go-popcount"
 )
 
 func TestInsertFourBits(t *testing.T) {
@@ -62,11 +65,19 @@ func TestInsertFourFuzz(t *testing.T) {
 		inbyte := byte(rand.Intn(256))
 		orig := generateByteString((rand.Intn(256) * rand.Intn(256)) + 1)
 		bytestr := make([]byte, len(orig))
+		wordbyte := make([]byte, len(orig))
 		realbyte := make([]byte, len(orig))
 		copy(realbyte, orig)
 		copy(bytestr, orig)
+		copy(wordbyte, orig)
 		out := insertFourBits(bytestr[1:], inbyte)
+		outword := insertFourBitsWord(wordbyte[1:], inbyte)
 		outreal := insertFourBitsGo(realbyte[1:], inbyte)
+		if !bytes.Equal(wordbyte, bytestr) || outword != out {
+			t.Logf("Mismatched word test case:\n{\nin: %#v,\ninByte: %#v,\ngot: %#v,\ngotOut: %#v,\nexpected: %#v,\nexpectedOut: %#v,\n},\n",
+				orig, inbyte, wordbyte, outword, bytestr, out)
+			t.Fail()
+		}
 		if !bytes.Equal(bytestr, realbyte) {
 			t.Logf("Mismatched test case:\n{\nin: %#v,\ninByte: %#v,\ngot: %#v,\ngotOut: %#v,\nexpected: %#v,\nexpectedOut: %#v,\n},\n",
 				orig, inbyte, bytestr, out, realbyte, outreal)
@@ -96,12 +107,21 @@ func TestInsertFourChainableFuzz(t *testing.T) {
 		n := 16 + rand.Intn(8)
 		orig := generateByteString((n * 2) + 1)
 		bytestr := make([]byte, len(orig))
+		wordbyte := make([]byte, len(orig))
 		realbyte := make([]byte, len(orig))
 		copy(realbyte, orig)
 		copy(bytestr, orig)
+		copy(wordbyte, orig)
 		out_a := insertFourBits(bytestr[1:n+1], inbyte)
 		out_b := insertFourBits(bytestr[n+1:], out_a)
+		word_a := insertFourBitsWord(wordbyte[1:n+1], inbyte)
+		word_b := insertFourBitsWord(wordbyte[n+1:], word_a)
 		outreal := insertFourBitsGo(realbyte[1:], inbyte)
+		if !bytes.Equal(wordbyte, bytestr) || word_b != out_b {
+			t.Logf("Mismatched word test case:\n{\nin: %#v,\ninByte: %#v,\ngot: %#v,\ngotOut: %#v,\nexpected: %#v,\nexpectedOut: %#v,\n},\n",
+				orig, inbyte, wordbyte, word_b, bytestr, out_b)
+			t.Fail()
+		}
 		if !bytes.Equal(bytestr, realbyte) {
 			t.Logf("Mismatched test case:\n{\nin: %#v,\ninByte: %#v,\ngot: %#v,\ngotOut: %#v,\nexpected: %#v,\nexpectedOut: %#v,\n},\n",
 				orig, inbyte, bytestr, out_b, realbyte, outreal)
@@ -113,3 +133,54 @@ func TestInsertFourChainableFuzz(t *testing.T) {
 		}
 	}
 }
+
+func BenchmarkInsertFourBits(b *testing.B) {
+	impls := []struct {
+		name string
+		f    func([]byte, byte) byte
+	}{
+		{"Native", insertFourBits},
+		{"Word", insertFourBitsWord},
+		{"Byte", insertFourBitsGo},
+	}
+	buf := generateByteString(16 * 1024)
+	for _, impl := range impls {
+		b.Run(impl.name, func(b *testing.B) {
+			b.SetBytes(int64(len(buf)))
+			for n := 0; n < b.N; n++ {
+				impl.f(buf, 0xA0)
+			}
+		})
+	}
+}
+
+func TestCountBytesFuzz(t *testing.T) {
+	for i := 0; i < FuzzIterations; i++ {
+		buf := generateByteString(rand.Intn(4096) + 1)
+		from := rand.Intn(len(buf))
+		to := from + rand.Intn(len(buf)-from+1)
+		expected := 0
+		for _, b := range buf[from:to] {
+			expected += bits.OnesCount8(b)
+		}
+		if got := countBytes(buf[from:to]); got != uint64(expected) {
+			t.Fatalf("Mismatched count for %d bytes at %d: got %d, expected %d", to-from, from, got, expected)
+		}
+	}
+}
+
+func BenchmarkCountBytes(b *testing.B) {
+	buf := generateByteString(16 * 1024)
+	b.Run("Native", func(b *testing.B) {
+		b.SetBytes(int64(len(buf)))
+		for n := 0; n < b.N; n++ {
+			countBytes(buf)
+		}
+	})
+	b.Run("Popcount", func(b *testing.B) {
+		b.SetBytes(int64(len(buf)))
+		for n := 0; n < b.N; n++ {
+			popcount.CountBytes(buf)
+		}
+	})
+}
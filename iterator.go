@@ -36,6 +36,13 @@ func (it *Iterator) Value() int {
 
 func (it *Iterator) getNext(off int) int {
 	try := off + 1
+	rows, cols := it.tree.Dims()
+	if !it.isRow {
+		rows, cols = cols, rows
+	}
+	if it.rowcol >= rows || try >= cols {
+		return -1
+	}
 	levels := it.tree.levels
 	nextval := it.getNextOnLevel(levels, 0, try)
 	return nextval
@@ -50,16 +57,10 @@ func (it *Iterator) getNextOnLevel(level, sublayeroff, val int) int {
 
 	startRun := sublayeroff * it.tree.tk.bitsPerLayer
 	levelStart := it.tree.levelOffsets[level]
-	var offInRun int
-	if it.isRow {
-		offInRun = it.tree.offsetTForLayer(it.rowcol, val, level)
-	} else {
-		offInRun = it.tree.offsetTForLayer(val, it.rowcol, level)
-	}
-	var newoffinrun int
+	shape := it.tree.shape(level)
 
 	for {
-		bitoff := levelStart + startRun + offInRun
+		bitoff := levelStart + startRun + it.offsetTForLayer(val, level)
 		if it.tree.tbits.Get(bitoff) {
 			count := it.tree.tbits.Count(levelStart, bitoff)
 			r := it.getNextOnLevel(level-1, count, val)
@@ -67,46 +68,54 @@ func (it *Iterator) getNextOnLevel(level, sublayeroff, val int) int {
 				return r
 			}
 		}
-		if it.isRow {
-			val = it.tree.incrementNForLevel(val, 1, level)
-			newoffinrun = it.tree.offsetTForLayer(it.rowcol, val, level)
-		} else {
-			panic("Is Column")
-		}
-		if newoffinrun < offInRun {
+		var ok bool
+		val, ok = it.advance(val, shape)
+		if !ok {
 			return -1
 		}
-		offInRun = newoffinrun
 	}
 }
 
 func (it *Iterator) getNextOnLeaf(leaflayercount, try int) int {
 	leafoffset := leaflayercount * it.tree.lk.bitsPerLayer
-	var bitoff, newbitoff int
-	if it.isRow {
-		bitoff = it.tree.offsetL(it.rowcol, try)
-	} else {
-		bitoff = it.tree.offsetL(try, it.rowcol)
-	}
+	shape := it.tree.leafShape()
 	for {
-		// Test
-		if it.tree.lbits.Get(leafoffset + bitoff) {
-			return try
-		}
-		// Increment on this layer
+		var bitoff int
 		if it.isRow {
-			try++
-			newbitoff = it.tree.offsetL(it.rowcol, try)
+			bitoff = it.tree.offsetL(it.rowcol, try)
 		} else {
-			panic("Is column")
+			bitoff = it.tree.offsetL(try, it.rowcol)
 		}
-		// See if we've run off the edge
-		if newbitoff < bitoff {
+		if it.tree.lbits.Get(leafoffset + bitoff) {
+			return try
+		}
+		var ok bool
+		try, ok = it.advance(try, shape)
+		if !ok {
 			return -1
 		}
-		bitoff = newbitoff
 	}
+}
+
+// offsetTForLayer returns the offset within a block on level of the
+// iterator's row or column crossed with val.
+func (it *Iterator) offsetTForLayer(val, level int) int {
+	if it.isRow {
+		return it.tree.offsetTForLayer(it.rowcol, val, level)
+	}
+	return it.tree.offsetTForLayer(val, it.rowcol, level)
+}
 
+// advance moves val to the start of the next run of cells along the
+// iterated axis of a level with the given shape. It returns false if that
+// run lies outside the current block.
+func (it *Iterator) advance(val int, s levelShape) (int, bool) {
+	shift, bits := s.colShift, s.colBits
+	if !it.isRow {
+		shift, bits = s.rowShift, s.rowBits
+	}
+	val = ((val >> shift) + 1) << shift
+	return val, (val>>shift)&(1<<bits-1) != 0
 }
 
 func (it *Iterator) ExtractAll() []int {
@@ -62,6 +62,35 @@ func TestRowIterator(t *testing.T) {
 	}
 }
 
+func TestColumnIterator(t *testing.T) {
+	k2, err := newK2Tree(func() bitarray { return &sliceArray{} }, DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	simpleLoad(k2)
+	tt := []struct {
+		col      int
+		expected []int
+	}{
+		{col: 17, expected: []int{20, 41}},
+		{col: 30, expected: []int{20, 30, 41}},
+		{col: 14, expected: []int{1, 20}},
+		{col: 3, expected: nil},
+		{col: 1 << 20, expected: nil},
+	}
+	for _, test := range tt {
+		out := k2.To(test.col).ExtractAll()
+		if len(out) != len(test.expected) {
+			t.Fatalf("column %d: got %v expected %v", test.col, out, test.expected)
+		}
+		for i := range out {
+			if out[i] != test.expected[i] {
+				t.Errorf("column %d: got %v expected %v", test.col, out, test.expected)
+			}
+		}
+	}
+}
+
 func BenchmarkExtract20Slice(b *testing.B) {
 	k2, err := newK2Tree(func() bitarray { return &sliceArray{} }, DefaultConfig)
 	if err != nil {
@@ -3,6 +3,10 @@ package k2tree
 type Config struct {
 	TreeLayerDef LayerDef
 	CellLayerDef LayerDef
+	// TreeBackend and CellBackend select how the tree and leaf bits are
+	// stored. The zero Backend picks the default for each.
+	TreeBackend Backend
+	CellBackend Backend
 }
 
 type LayerDef struct {
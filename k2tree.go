@@ -1,17 +1,40 @@
 package k2tree
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrNegativeNode is returned when adding a link to or from a node below
+// zero.
+var ErrNegativeNode = errors.New("k2tree: node indices must be non-negative")
+
+// checkNodes returns ErrNegativeNode unless i and j are both non-negative.
+func checkNodes(i, j int) error {
+	if i < 0 || j < 0 {
+		return ErrNegativeNode
+	}
+	return nil
+}
 
 // K2Tree is the main data structure for this package. It represents a compressed representation of
 // a graph adjacency matrix.
 type K2Tree struct {
-	tbits        bitarray
-	lbits        bitarray
-	tk           LayerDef
-	lk           LayerDef
-	count        int
-	levels       int
-	levelOffsets []int
+	levelBits
+	tk          LayerDef
+	lk          LayerDef
+	count       int
+	shapes      []levelShape
+	rectangular bool
+	newTree     newBitArrayFunc
+	newLeaf     newBitArrayFunc
+	// store is set for trees opened from a file.
+	store *treeStore
+	// release is set for snapshots, and releases the pages they share with
+	// the tree they were taken from.
+	release func()
+	// observers is set once something registers to hear of changes.
+	observers *observers
 }
 
 // New creates a new K2 Tree with the default creation options.
@@ -20,46 +43,190 @@ func New() (*K2Tree, error) {
 }
 
 func NewWithConfig(config Config) (*K2Tree, error) {
-	return newK2Tree(func() bitarray {
-		return newBinaryLRUIndex(newPagedSliceArray(1024*128), 128)
-	}, config)
+	treeFunc, err := config.TreeBackend.withDefaults(defaultTreeBackend).newFunc()
+	if err != nil {
+		return nil, err
+	}
+	return newK2Tree(treeFunc, config)
+}
+
+// NewWithBitArrays creates a new K2 Tree that stores its bits in the
+// BitArrays returned by tree and leaf. Each call must return a new, empty
+// BitArray; the tree asks for more when it's rebuilt, as by Compact.
+func NewWithBitArrays(tree, leaf func() BitArray, config Config) (*K2Tree, error) {
+	k, err := newK2Tree(wrapBitArrayFunc(tree), config)
+	if err != nil {
+		return nil, err
+	}
+	k.newLeaf = wrapBitArrayFunc(leaf)
+	k.lbits = k.newLeaf()
+	if k.tbits.Len() != 0 || k.lbits.Len() != 0 {
+		return nil, errors.New("bitarrays must start out empty")
+	}
+	return k, nil
+}
+
+// NewRectangular creates a new K2 Tree whose row and column extents grow
+// independently. A tall, narrow relation (say, ten million rows by a thousand
+// columns) only adds row splits to the top of the tree once the columns are
+// covered, instead of being stored as a square matrix of the larger size.
+func NewRectangular(config Config) (*K2Tree, error) {
+	k, err := NewWithConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	k.rectangular = true
+	return k, nil
+}
+
+// NewWithSize creates a new rectangular K2 Tree (see NewRectangular) with
+// all the levels needed to hold a matrix of rows by cols allocated up front,
+// so that filling it never has to grow the tree.
+func NewWithSize(rows, cols int, config Config) (*K2Tree, error) {
+	if rows <= 0 || cols <= 0 {
+		return nil, errors.New("matrix dimensions must be positive")
+	}
+	k, err := NewRectangular(config)
+	if err != nil {
+		return nil, err
+	}
+	err = k.initTree(rows-1, cols-1)
+	if err != nil {
+		return nil, err
+	}
+	return k, nil
 }
 
 func newK2Tree(sliceFunc newBitArrayFunc, config Config) (*K2Tree, error) {
-	t := sliceFunc()
-	l := newPagedBitarray(1024*128, 0.8, 0.3)
+	leafFunc, err := config.CellBackend.withDefaults(defaultLeafBackend).newFunc()
+	if err != nil {
+		return nil, err
+	}
 	return &K2Tree{
-		tbits:  t,
-		lbits:  l,
-		tk:     config.TreeLayerDef,
-		lk:     config.CellLayerDef,
-		levels: 0,
+		levelBits: levelBits{
+			tbits:  sliceFunc(),
+			lbits:  leafFunc(),
+			tBlock: config.TreeLayerDef.bitsPerLayer,
+			lBlock: config.CellLayerDef.bitsPerLayer,
+		},
+		tk:      config.TreeLayerDef,
+		lk:      config.CellLayerDef,
+		newTree: sliceFunc,
+		newLeaf: leafFunc,
 	}, nil
 }
 
-// maxIndex returns the largest node index representable by this
-// K2Tree.
-func (k *K2Tree) maxIndex() int {
+// rowExtent returns the number of rows representable by this K2Tree.
+func (k *K2Tree) rowExtent() int {
+	s := k.shape(k.levels)
+	return 1 << (s.rowShift + s.rowBits)
+}
+
+// colExtent returns the number of columns representable by this K2Tree.
+func (k *K2Tree) colExtent() int {
+	s := k.shape(k.levels)
+	return 1 << (s.colShift + s.colBits)
+}
+
+// Dims returns the number of rows and columns the tree can currently
+// represent without growing.
+func (k *K2Tree) Dims() (rows, cols int) {
 	if k.levels == 0 {
-		return 0
+		return 0, 0
 	}
-	x := intPow(k.tk.kPerLayer, k.levels) * k.lk.kPerLayer
-	return x
+	return k.rowExtent(), k.colExtent()
 }
 
 // Add asserts the existence of a link from node i to node j.
 // i and j are zero-indexed, the tree will grow to support them if larger
-// than the tree.
+// than the tree. Negative indices return ErrNegativeNode.
 func (k *K2Tree) Add(i, j int) error {
+	_, err := k.TryAdd(i, j)
+	return err
+}
+
+// TryAdd is Add, and also reports whether the link is new, rather than
+// already in the tree.
+func (k *K2Tree) TryAdd(i, j int) (added bool, err error) {
+	err = k.writable()
+	if err != nil {
+		return false, err
+	}
+	err = checkNodes(i, j)
+	if err != nil {
+		return false, err
+	}
+	// Everything that can fail on the tree happens before the link is
+	// logged, so the log never holds an Add that failed.
+	levels := k.levels
+	bitoff, err := k.reserve(i, j)
+	if err != nil {
+		return false, err
+	}
+	k.notifyGrown(levels)
+	if k.lbits.Get(bitoff) {
+		return false, nil
+	}
+	err = k.logChange(walAdd, link{i, j})
+	if err != nil {
+		return false, err
+	}
+	k.lbits.Set(bitoff, true)
+	k.notify(Change{Kind: LinkAdded, From: i, To: j})
+	k.changed()
+	return true, nil
+}
+
+// insert sets the link from i to j, growing the tree to hold it.
+func (k *K2Tree) insert(i, j int) (added bool, err error) {
+	bitoff, err := k.reserve(i, j)
+	if err != nil || k.lbits.Get(bitoff) {
+		return false, err
+	}
+	k.lbits.Set(bitoff, true)
+	return true, nil
+}
+
+// reserve grows the tree to hold the link from i to j and adds the blocks
+// that lead to it, and returns its offset in lbits.
+func (k *K2Tree) reserve(i, j int) (bitoff int, err error) {
 	if k.tbits.Len() == 0 {
-		k.initTree(max(i, j))
-	} else if i >= k.maxIndex() || j >= k.maxIndex() {
-		err := k.growTree(max(i, j))
-		if err != nil {
-			return err
-		}
+		err = k.initTree(i, j)
+	} else if i >= k.rowExtent() || j >= k.colExtent() {
+		err = k.growTree(i, j)
+	}
+	if err != nil {
+		return 0, err
+	}
+	var buf [maxLevels]int
+	return k.reserveCell(k.cell(i, j, &buf))
+}
+
+// Remove deletes the link from node i to node j, if it exists. The blocks
+// that led to it are kept, even if they become empty; Compact reclaims them.
+func (k *K2Tree) Remove(i, j int) error {
+	err := k.writable()
+	if err != nil {
+		return err
+	}
+	bitoff, ok := k.findLeaf(i, j)
+	if !ok || !k.lbits.Get(bitoff) {
+		return nil
+	}
+	err = k.logChange(walRemove, link{i, j})
+	if err != nil {
+		return err
 	}
-	return k.add(i, j)
+	k.lbits.Set(bitoff, false)
+	k.notify(Change{Kind: LinkRemoved, From: i, To: j})
+	k.changed()
+	return nil
+}
+
+// Contains returns whether there is a link from node i to node j.
+func (k *K2Tree) Contains(i, j int) bool {
+	bitoff, ok := k.findLeaf(i, j)
+	return ok && k.lbits.Get(bitoff)
 }
 
 // Stats returns some statistics about the memory usage of the K2 tree.
@@ -128,7 +295,7 @@ func (k *K2Tree) printLevel(l, highlight int) {
 
 }
 func (k *K2Tree) printTree() {
-	fmt.Println(k.levelOffsets, k.maxIndex())
+	fmt.Println(k.levelOffsets, k.rowExtent(), k.colExtent())
 	for l := k.levels; l >= 1; l-- {
 		k.printLevel(l, -1)
 	}
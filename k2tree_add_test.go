@@ -1,7 +1,9 @@
 package k2tree
 
 import (
+	"errors"
 	"fmt"
+	"reflect"
 	"testing"
 	"time"
 )
@@ -92,3 +94,91 @@ func TestRandAddTestCase(t *testing.T) {
 	}
 
 }
+
+func TestTryAdd(t *testing.T) {
+	k, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	added, err := k.TryAdd(5, 7)
+	if err != nil || !added {
+		t.Fatalf("first TryAdd = %v, %v; expected true, nil", added, err)
+	}
+	added, err = k.TryAdd(5, 7)
+	if err != nil || added {
+		t.Fatalf("second TryAdd = %v, %v; expected false, nil", added, err)
+	}
+	k.Remove(5, 7)
+	added, _ = k.TryAdd(5, 7)
+	if !added {
+		t.Error("TryAdd of a removed link should report it as new")
+	}
+}
+
+var errFull = errors.New("array is full")
+
+// fullArray is a boolArray that refuses to grow past limit bits.
+type fullArray struct {
+	boolArray
+	limit int
+}
+
+func (f *fullArray) Insert(n, at int) error {
+	if f.Len()+n > f.limit {
+		return errFull
+	}
+	return f.boolArray.Insert(n, at)
+}
+
+func TestAddPropagatesErrors(t *testing.T) {
+	k, err := NewWithBitArrays(func() BitArray {
+		return &fullArray{limit: 200}
+	}, func() BitArray {
+		return &boolArray{}
+	}, DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var failed error
+	for x := 0; x < 100 && failed == nil; x++ {
+		failed = k.Add(x*37, x*91)
+	}
+	if failed != errFull {
+		t.Fatalf("expected %v from Add, got %v", errFull, failed)
+	}
+	// The failed Add must leave the existing links reachable.
+	for x := 0; x < k.lbits.Total(); x++ {
+		if !k.Contains(x*37, x*91) {
+			t.Errorf("lost link %d after a failed Add", x)
+		}
+	}
+}
+
+func TestAddNegative(t *testing.T) {
+	k, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	simpleLoad(k)
+	expected := linkSet(k)
+	if err := k.Add(-1, 0); err != ErrNegativeNode {
+		t.Errorf("expected ErrNegativeNode from Add, got %v", err)
+	}
+	if _, err := k.AddBatch([]Edge{{1, 1}, {-3, 2}}); err != ErrNegativeNode {
+		t.Errorf("expected ErrNegativeNode from AddBatch, got %v", err)
+	}
+	b := &BufferedK2Tree{tree: k, size: DefaultBufferSize}
+	if err := b.Add(0, -1); err != ErrNegativeNode {
+		t.Errorf("expected ErrNegativeNode from a buffered Add, got %v", err)
+	}
+	txn := k.Begin()
+	if err := txn.Add(-1, -1); err != ErrNegativeNode {
+		t.Errorf("expected ErrNegativeNode from a Txn Add, got %v", err)
+	}
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(linkSet(k), expected) || b.Buffered() != 0 {
+		t.Error("a negative link changed the tree")
+	}
+}
@@ -0,0 +1,169 @@
+package k2tree
+
+// Edge is a link from node From to node To.
+type Edge struct {
+	From int
+	To   int
+}
+
+// AddBatch asserts the existence of every edge in edges, growing the tree
+// as needed, and returns how many of them weren't already in the tree.
+//
+// Rather than adding the edges one at a time, the batch is sorted into tree
+// order and its new blocks are inserted a level at a time, in the same
+// order. The counts that locate each block are carried along from one block
+// to the next instead of being taken again from the start of the level, and
+// new blocks that end up next to each other are inserted with a single
+// Insert. If an error is returned, the links of the tree are unchanged,
+// though it may have grown, and gained empty blocks as Remove leaves them.
+func (k *K2Tree) AddBatch(edges []Edge) (added int, err error) {
+	err = k.writable()
+	if err != nil {
+		return 0, err
+	}
+	links := make([]link, len(edges))
+	for x, e := range edges {
+		err = checkNodes(e.From, e.To)
+		if err != nil {
+			return 0, err
+		}
+		links[x] = link{e.From, e.To}
+	}
+	added, err = k.addLinks(links)
+	if err != nil {
+		return 0, err
+	}
+	k.changed()
+	return added, nil
+}
+
+// addLinks is AddBatch on links, which it reorders. The new links are logged
+// as one transaction once every block they need is in place, and before
+// their bits are set, so the log never holds a batch that failed and a torn
+// write loses the whole batch.
+func (k *K2Tree) addLinks(links []link) (added int, err error) {
+	if len(links) == 0 {
+		return 0, nil
+	}
+	var maxi, maxj int
+	for _, l := range links {
+		maxi = max(maxi, l.i)
+		maxj = max(maxj, l.j)
+	}
+	levels := k.levels
+	if k.levels == 0 {
+		err = k.initTree(maxi, maxj)
+	} else if maxi >= k.rowExtent() || maxj >= k.colExtent() {
+		err = k.growTree(maxi, maxj)
+	}
+	if err != nil {
+		return 0, err
+	}
+	k.notifyGrown(levels)
+	k.sortLinks(links)
+	uniq := links[:1]
+	for _, l := range links[1:] {
+		if l != uniq[len(uniq)-1] {
+			uniq = append(uniq, l)
+		}
+	}
+	leaves, err := k.reserveLinks(uniq)
+	if err != nil {
+		return 0, err
+	}
+	var fresh []link
+	var freshLeaves []int
+	for x, l := range uniq {
+		if !k.lbits.Get(leaves[x]) {
+			fresh = append(fresh, l)
+			freshLeaves = append(freshLeaves, leaves[x])
+		}
+	}
+	err = k.logTxn(fresh, nil)
+	if err != nil {
+		return 0, err
+	}
+	var changes []Change
+	for x, l := range fresh {
+		k.lbits.Set(freshLeaves[x], true)
+		if k.observed() {
+			changes = append(changes, Change{Kind: LinkAdded, From: l.i, To: l.j})
+		}
+	}
+	k.notify(changes...)
+	return len(fresh), nil
+}
+
+// batchBlock is a block that links[lo:hi] of a batch fall in, the index-th
+// block of its level.
+type batchBlock struct {
+	index int
+	lo    int
+	hi    int
+}
+
+// reserveLinks adds the blocks that lead to each of links, which must be in
+// tree order, free of duplicates and within the tree, and returns the offset
+// of each in lbits, as reserveCell does for a single cell.
+//
+// Each level is handled in one pass over the blocks the links fall in, from
+// the top down. The pass finds the bits of the level that need a new block
+// beneath them, and where that block goes on the level below, then inserts
+// the new blocks in runs of adjacent ones, each run before the bits pointing
+// at it are set. A failed Insert leaves the runs before it in place with
+// their bits set, so the tree only gains empty blocks.
+func (k *K2Tree) reserveLinks(links []link) ([]int, error) {
+	blocks := []batchBlock{{index: 0, lo: 0, hi: len(links)}}
+	for l := k.levels; l > 0; l-- {
+		levelStart := k.levelOffsets[l]
+		// rank counts the set bits of the level before pos, which the next
+		// Count picks up from. fresh are the bits that are to be set, and
+		// children the indices of the new blocks beneath them.
+		rank, pos := 0, levelStart
+		var fresh, children []int
+		var next []batchBlock
+		for _, b := range blocks {
+			base := levelStart + b.index*k.tBlock
+			for x := b.lo; x < b.hi; {
+				off := k.offsetTForLayer(links[x].i, links[x].j, l)
+				lo := x
+				for x < b.hi && k.offsetTForLayer(links[x].i, links[x].j, l) == off {
+					x++
+				}
+				bit := base + off
+				rank += k.tbits.Count(pos, bit)
+				pos = bit
+				// The block beneath bit comes after the blocks beneath the
+				// bits before it, old and new.
+				child := rank + len(fresh)
+				if !k.tbits.Get(bit) {
+					fresh = append(fresh, bit)
+					children = append(children, child)
+				}
+				next = append(next, batchBlock{child, lo, x})
+			}
+		}
+		for x := 0; x < len(fresh); {
+			n := 1
+			for x+n < len(fresh) && children[x+n] == children[x]+n {
+				n++
+			}
+			err := k.insertBlocks(l-1, children[x], n)
+			if err != nil {
+				return nil, err
+			}
+			for ; n > 0; n-- {
+				k.tbits.Set(fresh[x], true)
+				x++
+			}
+		}
+		blocks = next
+	}
+	var leaves []int
+	for _, b := range blocks {
+		for x := b.lo; x < b.hi; x++ {
+			leaves = append(leaves, b.index*k.lBlock+k.offsetL(links[x].i, links[x].j))
+		}
+	}
+	return leaves, nil
+}
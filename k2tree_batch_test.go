@@ -0,0 +1,146 @@
+package k2tree
+
+import (
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestAddBatch(t *testing.T) {
+	newTrees := map[string]func() (*K2Tree, error){
+		"Default":  New,
+		"FourFour": func() (*K2Tree, error) { return NewWithConfig(FourFourConfig) },
+		"Rectangular": func() (*K2Tree, error) {
+			return NewRectangular(SixteenFourConfig)
+		},
+	}
+	for name, newTree := range newTrees {
+		t.Run(name, func(t *testing.T) {
+			batched, err := newTree()
+			if err != nil {
+				t.Fatal(err)
+			}
+			single, err := newTree()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for round := 0; round < 4; round++ {
+				var edges []Edge
+				expected := 0
+				for x := 0; x < 500; x++ {
+					e := Edge{rand.Intn(300 << uint(round*3)), rand.Intn(200)}
+					if round == 2 {
+						e.From, e.To = e.To, e.From
+					}
+					edges = append(edges, e)
+					if !single.Contains(e.From, e.To) {
+						expected++
+					}
+					single.Add(e.From, e.To)
+				}
+				// Repeat a few edges within the batch and from earlier rounds.
+				edges = append(edges, edges[:20]...)
+				added, err := batched.AddBatch(edges)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if added != expected {
+					t.Errorf("round %d: AddBatch added %d links, expected %d", round, added, expected)
+				}
+				if !reflect.DeepEqual(sortedLinks(batched), sortedLinks(single)) {
+					t.Fatalf("round %d: batched tree has different links", round)
+				}
+				// Growing a rectangular tree all at once may split the axes in
+				// a different order than growing it link by link.
+				if !reflect.DeepEqual(batched.shapes, single.shapes) {
+					continue
+				}
+				if batched.tbits.Len() != single.tbits.Len() || batched.lbits.Len() != single.lbits.Len() {
+					t.Errorf("round %d: batched tree has %d/%d bits, expected %d/%d", round,
+						batched.tbits.Len(), batched.lbits.Len(), single.tbits.Len(), single.lbits.Len())
+				}
+			}
+			for x := 0; x < 50; x++ {
+				i := rand.Intn(300)
+				checkIterator(t, batched.From(i), single.From(i).ExtractAll())
+			}
+		})
+	}
+}
+
+func sortedLinks(k *K2Tree) []link {
+	links := k.links()
+	sort.Slice(links, func(x, y int) bool {
+		if links[x].i != links[y].i {
+			return links[x].i < links[y].i
+		}
+		return links[x].j < links[y].j
+	})
+	return links
+}
+
+func TestAddBatchRestoresRemoved(t *testing.T) {
+	k2, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	simpleLoad(k2)
+	k2.Remove(20, 14)
+	added, err := k2.AddBatch([]Edge{{20, 14}, {14, 20}, {3000, 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != 2 {
+		t.Errorf("expected 2 new links, got %d", added)
+	}
+	if !k2.Contains(20, 14) || !k2.Contains(3000, 2) {
+		t.Error("batched links missing")
+	}
+}
+
+func TestAddBatchFailsPartway(t *testing.T) {
+	var tree *fullArray
+	k2, err := NewWithBitArrays(func() BitArray {
+		tree = &fullArray{limit: 1 << 20}
+		return tree
+	}, func() BitArray {
+		return &boolArray{}
+	}, DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	simpleLoad(k2)
+	k2.Add(4000, 4000)
+	expected := linkSet(k2)
+	var edges []Edge
+	for x := 0; x < 8; x++ {
+		edges = append(edges, Edge{x * 500, 3999 - x*500})
+	}
+	// Leave room for some of the new blocks, but not all of them.
+	before := k2.tbits.Len()
+	tree.limit = before + 2*k2.tBlock
+	if _, err := k2.AddBatch(edges); err != errFull {
+		t.Fatalf("expected %v from AddBatch, got %v", errFull, err)
+	}
+	if k2.tbits.Len() == before {
+		t.Fatal("expected some of the new blocks to be inserted")
+	}
+	if !reflect.DeepEqual(linkSet(k2), expected) {
+		t.Fatal("a failed AddBatch changed the links of the tree")
+	}
+	tree.limit = 1 << 20
+	added, err := k2.AddBatch(edges)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != len(edges) {
+		t.Errorf("expected %d new links, got %d", len(edges), added)
+	}
+	for _, e := range edges {
+		expected[link{e.From, e.To}] = true
+	}
+	if !reflect.DeepEqual(linkSet(k2), expected) {
+		t.Error("the batch wasn't added after a failed AddBatch")
+	}
+}
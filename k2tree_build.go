@@ -0,0 +1,164 @@
+package k2tree
+
+import "sort"
+
+// link is a single set cell of the matrix.
+type link struct {
+	i int
+	j int
+}
+
+// Compact rebuilds the tree, reclaiming the empty blocks left behind by
+// Remove and dropping top levels that only lead to their first child (that
+// is, when every link fits in the first quadrant of the matrix).
+func (k *K2Tree) Compact() error {
+	err := k.writable()
+	if err != nil {
+		return err
+	}
+	if k.levels == 0 {
+		return nil
+	}
+	links := k.links()
+	var maxi, maxj int
+	for _, l := range links {
+		maxi = max(maxi, l.i)
+		maxj = max(maxj, l.j)
+	}
+	levels := k.levels
+	for levels > 1 {
+		below := k.shapes[levels-1]
+		if maxi >= 1<<(below.rowShift+below.rowBits) || maxj >= 1<<(below.colShift+below.colBits) {
+			break
+		}
+		levels--
+	}
+	// Dropping top levels leaves the shapes of the ones below as they are,
+	// so the tree is built before any of it changes.
+	bits, err := k.build(links, levels)
+	if err != nil {
+		return err
+	}
+	k.levelBits = bits
+	k.shapes = k.shapes[:levels+1]
+	if k.store != nil {
+		k.store.rebuilt = true
+	}
+	k.notify(Change{Kind: TreeCompacted, Levels: k.levels})
+	return nil
+}
+
+// links returns every link in the tree, in tree order.
+func (k *K2Tree) links() []link {
+	var out []link
+	k.forEachLink(func(i, j int) {
+		out = append(out, link{i, j})
+	})
+	return out
+}
+
+// treeLess reports whether a comes before b in tree order, the order in which
+// walk visits the cells. On a square tree this is Z-order.
+func (k *K2Tree) treeLess(a, b link) bool {
+	for l := k.levels; l > 0; l-- {
+		oa, ob := k.offsetTForLayer(a.i, a.j, l), k.offsetTForLayer(b.i, b.j, l)
+		if oa != ob {
+			return oa < ob
+		}
+	}
+	return k.offsetL(a.i, a.j) < k.offsetL(b.i, b.j)
+}
+
+// sortLinks sorts links into tree order. Every link must lie within the
+// tree.
+func (k *K2Tree) sortLinks(links []link) {
+	sort.Slice(links, func(x, y int) bool {
+		return k.treeLess(links[x], links[y])
+	})
+}
+
+// forEachLink calls fn for every link in the tree, in tree order.
+func (k *K2Tree) forEachLink(fn func(i, j int)) {
+	if k.levels == 0 {
+		return
+	}
+	k.walk(k.levels, 0, 0, 0, fn)
+}
+
+// walk visits the links below the block-th block of level, whose first cell
+// is at i, j.
+func (k *K2Tree) walk(level, block, i, j int, fn func(i, j int)) {
+	if level == 0 {
+		base := block * k.lk.bitsPerLayer
+		for off := 0; off < k.lk.bitsPerLayer; off++ {
+			if k.lbits.Get(base + off) {
+				fn(i+(off>>k.lk.shiftPerLayer), j+(off&k.lk.maskPerLayer))
+			}
+		}
+		return
+	}
+	s := k.shapes[level]
+	levelStart := k.levelOffsets[level]
+	base := levelStart + block*k.tk.bitsPerLayer
+	for off := 0; off < k.tk.bitsPerLayer; off++ {
+		if !k.tbits.Get(base + off) {
+			continue
+		}
+		x := off >> s.colBits
+		y := off & (1<<s.colBits - 1)
+		count := k.tbits.Count(levelStart, base+off)
+		k.walk(level-1, count, i+x<<s.rowShift, j+y<<s.colShift, fn)
+	}
+}
+
+// build returns fresh bitarrays holding exactly links, which must be in tree
+// order and free of duplicates, in the bottom levels levels of the tree's
+// shape. The tree itself is left as it is. Levels are written top-down,
+// which is the order they're stored in, so every Insert appends.
+func (k *K2Tree) build(links []link, levels int) (levelBits, error) {
+	tbits := k.newTree()
+	lbits := k.newLeaf()
+	offsets := make([]int, levels+1)
+	// bounds delimits the runs of links under each block of the current
+	// level: block n holds links[bounds[n]:bounds[n+1]].
+	bounds := []int{0, len(links)}
+	for l := levels; l > 0; l-- {
+		offsets[l] = tbits.Len()
+		var next []int
+		for n := 0; n+1 < len(bounds); n++ {
+			base := tbits.Len()
+			err := tbits.Insert(k.tk.bitsPerLayer, base)
+			if err != nil {
+				return levelBits{}, err
+			}
+			prev := -1
+			for x := bounds[n]; x < bounds[n+1]; x++ {
+				off := k.offsetTForLayer(links[x].i, links[x].j, l)
+				if off != prev {
+					tbits.Set(base+off, true)
+					next = append(next, x)
+					prev = off
+				}
+			}
+		}
+		bounds = append(next, len(links))
+	}
+	for n := 0; n+1 < len(bounds); n++ {
+		base := lbits.Len()
+		err := lbits.Insert(k.lk.bitsPerLayer, base)
+		if err != nil {
+			return levelBits{}, err
+		}
+		for x := bounds[n]; x < bounds[n+1]; x++ {
+			lbits.Set(base+k.offsetL(links[x].i, links[x].j), true)
+		}
+	}
+	return levelBits{
+		tbits:        tbits,
+		lbits:        lbits,
+		levels:       levels,
+		levelOffsets: offsets,
+		tBlock:       k.tBlock,
+		lBlock:       k.lBlock,
+	}, nil
+}
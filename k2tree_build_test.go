@@ -0,0 +1,132 @@
+package k2tree
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestNewWithSize(t *testing.T) {
+	k2, err := NewWithSize(100000, 300, SixteenFourConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, cols := k2.Dims()
+	if rows < 100000 || cols < 300 || cols >= 100000 {
+		t.Fatalf("unexpected dimensions %d x %d", rows, cols)
+	}
+	levels := k2.levels
+	k2.Add(99999, 299)
+	k2.Add(0, 0)
+	if k2.levels != levels {
+		t.Errorf("tree grew from %d to %d levels", levels, k2.levels)
+	}
+	if !k2.Contains(99999, 299) || !k2.Contains(0, 0) || k2.Contains(1, 1) {
+		t.Error("wrong contents")
+	}
+	_, err = NewWithSize(0, 10, SixteenFourConfig)
+	if err == nil {
+		t.Error("expected an error for an empty matrix")
+	}
+}
+
+func TestRemove(t *testing.T) {
+	k2, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	simpleLoad(k2)
+	k2.Remove(20, 14)
+	k2.Remove(20, 15)
+	k2.Remove(5000, 5000)
+	if k2.Contains(20, 14) {
+		t.Error("removed link still present")
+	}
+	if !k2.Contains(14, 20) {
+		t.Error("unrelated link was removed")
+	}
+	checkIterator(t, k2.From(20), []int{1, 2, 17, 30, 41})
+}
+
+func TestCompact(t *testing.T) {
+	k2, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := make(map[int][]int)
+	for x := 0; x < 500; x++ {
+		i := rand.Intn(200)
+		j := rand.Intn(200)
+		if !k2.Contains(i, j) {
+			expected[i] = append(expected[i], j)
+		}
+		k2.Add(i, j)
+	}
+	for x := 0; x < 50; x++ {
+		k2.Add(100000+x, 5)
+		k2.Remove(100000+x, 5)
+	}
+	levels := k2.levels
+	bits := k2.tbits.Len()
+	links := k2.lbits.Total()
+	err = k2.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k2.levels >= levels {
+		t.Errorf("expected fewer than %d levels, got %d", levels, k2.levels)
+	}
+	if k2.tbits.Len() >= bits {
+		t.Errorf("expected fewer than %d tree bits, got %d", bits, k2.tbits.Len())
+	}
+	if k2.lbits.Total() != links {
+		t.Errorf("expected %d links, got %d", links, k2.lbits.Total())
+	}
+	for i, js := range expected {
+		checkIterator(t, k2.From(i), js)
+	}
+	k2.Add(100000, 5)
+	checkIterator(t, k2.To(5), append(expectedColumn(expected, 5), 100000))
+}
+
+func expectedColumn(rows map[int][]int, j int) []int {
+	var out []int
+	for i, js := range rows {
+		for _, x := range js {
+			if x == j {
+				out = append(out, i)
+			}
+		}
+	}
+	return out
+}
+
+func TestCompactFails(t *testing.T) {
+	limit := 1 << 20
+	k2, err := NewWithBitArrays(func() BitArray {
+		return &fullArray{limit: limit}
+	}, func() BitArray {
+		return &boolArray{}
+	}, DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for x := 0; x < 100; x++ {
+		k2.Add(x*3, x*7)
+	}
+	k2.Add(100000, 5)
+	k2.Remove(100000, 5)
+	expected := linkSet(k2)
+	levels := k2.levels
+	offsets := append([]int(nil), k2.levelOffsets...)
+	limit = 0
+	if err := k2.Compact(); err != errFull {
+		t.Fatalf("expected %v from Compact, got %v", errFull, err)
+	}
+	if k2.levels != levels || !reflect.DeepEqual(k2.levelOffsets, offsets) || len(k2.shapes) != levels+1 {
+		t.Error("a failed Compact changed the shape of the tree")
+	}
+	if !reflect.DeepEqual(linkSet(k2), expected) {
+		t.Error("a failed Compact changed the links of the tree")
+	}
+}
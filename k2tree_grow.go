@@ -22,33 +22,84 @@ L  0110|0111|0101|0101|0001|1001|1000|1001|1011|1010|1100|1001|0001|0100
 
 */
 
-// necessaryLayer computes the number of layers necessary to
-// represent index i
-func (k *K2Tree) necessaryLayer(i int) int {
-	// Level 1
-	n := k.lk.kPerLayer * k.tk.kPerLayer
-	l := 1
-	for n <= i {
-		n *= k.tk.kPerLayer
-		l++
+// levelShape describes how a level of the tree divides the region of the
+// matrix beneath it. Square levels split both axes by kPerLayer. Levels of a
+// rectangular tree that only need to cover one axis split that axis by
+// bitsPerLayer instead, so every block on every level has the same number of
+// bits.
+type levelShape struct {
+	// rowBits and colBits are log2 of the number of row and column splits.
+	rowBits uint
+	colBits uint
+	// rowShift and colShift are the number of index bits consumed by the
+	// levels below.
+	rowShift uint
+	colShift uint
+}
+
+// leafShape returns the shape of the leaf layer.
+func (k *K2Tree) leafShape() levelShape {
+	return levelShape{
+		rowBits: k.lk.shiftPerLayer,
+		colBits: k.lk.shiftPerLayer,
+	}
+}
+
+// nextShape returns the shape of a level placed on top of below, splitting
+// the rows, the columns, or both.
+func (k *K2Tree) nextShape(below levelShape, rows, cols bool) levelShape {
+	s := levelShape{
+		rowShift: below.rowShift + below.rowBits,
+		colShift: below.colShift + below.colBits,
+	}
+	switch {
+	case rows && cols:
+		s.rowBits = k.tk.shiftPerLayer
+		s.colBits = k.tk.shiftPerLayer
+	case rows:
+		s.rowBits = 2 * k.tk.shiftPerLayer
+	default:
+		s.colBits = 2 * k.tk.shiftPerLayer
+	}
+	return s
+}
+
+// shape returns the shape of level l, where level 0 is the leaf layer.
+// Levels above the top of the tree are square.
+func (k *K2Tree) shape(l int) levelShape {
+	if l < len(k.shapes) {
+		return k.shapes[l]
+	}
+	s := k.leafShape()
+	n := 1
+	if len(k.shapes) != 0 {
+		s = k.shapes[len(k.shapes)-1]
+		n = len(k.shapes)
+	}
+	for ; n <= l; n++ {
+		s = k.nextShape(s, true, true)
 	}
-	return l
+	return s
+}
+
+// growthAxes reports which axes a new top level must split in order to
+// cover i, j. Square trees always split both.
+func (k *K2Tree) growthAxes(i, j int) (rows, cols bool) {
+	rows, cols = i >= k.rowExtent(), j >= k.colExtent()
+	if !k.rectangular || rows == cols {
+		return true, true
+	}
+	return rows, cols
 }
 
 // offsetTForLayer returns the offset of i, j in layer l.
 // In the above example, i=6, j=2:
 // if l=2 == 1 (top right), if l=1 == 3 (bottom right)
 func (k *K2Tree) offsetTForLayer(i int, j int, l int) int {
-	spl := uint(l-1)*(k.tk.shiftPerLayer) + k.lk.shiftPerLayer
-	x := (i & (k.tk.maskPerLayer << spl)) >> spl
-	y := (j & (k.tk.maskPerLayer << spl)) >> spl
-	return (x * k.tk.kPerLayer) + y
-}
-
-// Increment n by the amt
-func (k *K2Tree) incrementNForLevel(n int, amt int, l int) int {
-	spl := uint(l-1)*(k.tk.shiftPerLayer) + k.lk.shiftPerLayer
-	return ((n >> spl) + amt) << spl
+	s := k.shape(l)
+	x := (i >> s.rowShift) & (1<<s.rowBits - 1)
+	y := (j >> s.colShift) & (1<<s.colBits - 1)
+	return x<<s.colBits | y
 }
 
 // returns the suboffset within the index of the lower bit layer
@@ -56,89 +107,55 @@ func (k *K2Tree) offsetL(i int, j int) int {
 	return ((i & k.lk.maskPerLayer) * k.lk.kPerLayer) + (j & k.lk.maskPerLayer)
 }
 
-// growTree grows the K2Tree to be large enough to represent size
-func (k *K2Tree) growTree(size int) error {
-	n := k.necessaryLayer(size)
-	for k.levels != n {
-		err := k.tbits.Insert(k.tk.bitsPerLayer, 0)
-		if err != nil {
-			return err
-		}
-		k.tbits.Set(0, true)
-		for x := len(k.levelOffsets) - 1; x > 0; x-- {
-			k.levelOffsets[x] += k.tk.bitsPerLayer
-		}
-		k.levelOffsets = append(k.levelOffsets, 0)
-		k.levels++
+// cell fills buf with the offsets of the cell at i, j within its block on
+// each level, as levelBits walks them.
+func (k *K2Tree) cell(i, j int, buf *[maxLevels]int) []int {
+	offsets := buf[:k.levels+1]
+	offsets[0] = k.offsetL(i, j)
+	for l := 1; l <= k.levels; l++ {
+		offsets[l] = k.offsetTForLayer(i, j, l)
 	}
-	return nil
+	return offsets
 }
 
-// initTree initializes a tree of the appropriate size
-func (k *K2Tree) initTree(size int) error {
-	l := k.necessaryLayer(size)
-	err := k.tbits.Insert(k.tk.bitsPerLayer, 0)
-	if err != nil {
-		return err
-	}
-	k.levels = l
-	k.levelOffsets = make([]int, l+1)
-	for x := l - 1; x > 0; x-- {
-		k.levelOffsets[x] = k.tk.bitsPerLayer
+// growTree grows the K2Tree to be large enough to represent i, j
+func (k *K2Tree) growTree(i, j int) error {
+	for i >= k.rowExtent() || j >= k.colExtent() {
+		rows, cols := k.growthAxes(i, j)
+		err := k.addLevel()
+		if err != nil {
+			return err
+		}
+		k.shapes = append(k.shapes, k.nextShape(k.shapes[k.levels-1], rows, cols))
 	}
 	return nil
 }
 
-// insertToLayer inserts a new layersize of bits in layer l
-// given an offset determined by the above layer.
-func (k *K2Tree) insertToLayer(l int, layerCount int) error {
-	if l == 0 {
-		return k.lbits.Insert(k.lk.bitsPerLayer, layerCount*k.lk.bitsPerLayer)
+// initTree initializes a tree of the appropriate size to hold i, j
+func (k *K2Tree) initTree(i, j int) error {
+	k.levels = 0
+	k.shapes = []levelShape{k.leafShape()}
+	for k.levels == 0 || i >= k.rowExtent() || j >= k.colExtent() {
+		rows, cols := k.growthAxes(i, j)
+		k.shapes = append(k.shapes, k.nextShape(k.shapes[k.levels], rows, cols))
+		k.levels++
 	}
-	targetBit := layerCount * k.tk.bitsPerLayer
-	err := k.tbits.Insert(k.tk.bitsPerLayer, targetBit+k.levelOffsets[l])
+	err := k.initLevels(k.levels)
 	if err != nil {
+		k.levels, k.shapes = 0, nil
 		return err
 	}
-	for x := l - 1; x > 0; x-- {
-		k.levelOffsets[x] += k.tk.bitsPerLayer
-	}
 	return nil
 }
 
-// add is the internal helper to set the appropriate bit at i,j.
-func (k *K2Tree) add(i, j int) error {
-	level := k.levels
-	if k.levelOffsets[level] != 0 {
-		panic("top level is not offset 0?")
-	}
-	var levelOffset int
-	var count int
-	for level != 0 {
-		levelStart := k.levelOffsets[level]
-		offset := k.offsetTForLayer(i, j, level)
-		bitoff := levelStart + levelOffset + offset
-		count = k.tbits.Count(levelStart, bitoff)
-		//fmt.Println(
-		//"level", level,
-		//"levelStart", levelStart,
-		//"offset", offset,
-		//"bitoff", bitoff,
-		//"count", count,
-		//)
-		if k.tbits.Get(bitoff) {
-			levelOffset = count * k.tk.bitsPerLayer
-		} else {
-			k.tbits.Set(bitoff, true)
-			k.insertToLayer(level-1, count)
-			levelOffset = count * k.tk.bitsPerLayer
-		}
-		level--
+// findLeaf returns the offset in lbits of the cell at i, j. ok is false if
+// the leaf block holding the cell doesn't exist.
+func (k *K2Tree) findLeaf(i, j int) (bitoff int, ok bool) {
+	if k.levels == 0 || i < 0 || j < 0 || i >= k.rowExtent() || j >= k.colExtent() {
+		return 0, false
 	}
-	offset := k.offsetL(i, j)
-	bitoff := (count * k.lk.bitsPerLayer) + offset
-	k.lbits.Set(bitoff, true)
-	return nil
+	var buf [maxLevels]int
+	return k.findCell(k.cell(i, j, &buf))
 }
 
 // debug debug-prints a K2Tree
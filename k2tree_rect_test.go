@@ -0,0 +1,79 @@
+package k2tree
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestRectangularAdd(t *testing.T) {
+	for _, k2config := range smallK2Configs {
+		t.Run(k2config.name, func(t *testing.T) {
+			rect, err := NewRectangular(k2config.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			square, err := NewWithConfig(k2config.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rows := make(map[int][]int)
+			cols := make(map[int][]int)
+			seen := make(map[[2]int]bool)
+			for x := 0; x < 2000; x++ {
+				i := rand.Intn(1000000)
+				j := rand.Intn(100)
+				rect.Add(i, j)
+				square.Add(i, j)
+				if seen[[2]int{i, j}] {
+					continue
+				}
+				seen[[2]int{i, j}] = true
+				rows[i] = append(rows[i], j)
+				cols[j] = append(cols[j], i)
+			}
+			r, c := rect.Dims()
+			if r < 1000000 || c < 100 || c >= 1000000 {
+				t.Errorf("unexpected dimensions %d x %d", r, c)
+			}
+			if rect.tbits.Len() >= square.tbits.Len() {
+				t.Errorf("rectangular tree is not smaller: %d vs %d bits", rect.tbits.Len(), square.tbits.Len())
+			}
+			for i, expected := range rows {
+				checkIterator(t, rect.From(i), expected)
+			}
+			for j, expected := range cols {
+				checkIterator(t, rect.To(j), expected)
+			}
+		})
+	}
+}
+
+func TestRectangularGrowBothAxes(t *testing.T) {
+	k2, err := NewRectangular(SixteenFourConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k2.Add(3, 5000)
+	k2.Add(70000, 2)
+	k2.Add(70000, 5000)
+	checkIterator(t, k2.From(3), []int{5000})
+	checkIterator(t, k2.From(70000), []int{2, 5000})
+	checkIterator(t, k2.To(5000), []int{3, 70000})
+	checkIterator(t, k2.To(2), []int{70000})
+}
+
+func checkIterator(t *testing.T, it *Iterator, expected []int) {
+	t.Helper()
+	out := it.ExtractAll()
+	expected = append([]int(nil), expected...)
+	sort.Ints(expected)
+	if len(out) != len(expected) {
+		t.Fatalf("got %v expected %v", out, expected)
+	}
+	for i := range out {
+		if out[i] != expected[i] {
+			t.Fatalf("got %v expected %v", out, expected)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package k2tree
+
+import (
+	"errors"
+	"fmt"
+)
+
+// KdTree is the d-dimensional generalization of a K2Tree: a compressed
+// representation of a set of points in a d-dimensional grid, such as the
+// (subject, predicate, object) triples of a ternary relation. Each level
+// splits every dimension 2^bitsPerDim ways, so blocks hold 2^(d*bitsPerDim)
+// bits; a K3Tree with one bit per dimension has 8-way blocks, and with two
+// bits per dimension 64-way blocks. It's stored in the same bitarrays as a
+// K2Tree.
+type KdTree struct {
+	levelBits
+	dims       int
+	bitsPerDim uint
+}
+
+// NewK3Tree creates a new three-dimensional KdTree with 8-way blocks.
+func NewK3Tree() (*KdTree, error) {
+	return NewKdTree(3, 1)
+}
+
+// NewKdTree creates a new KdTree over points of dims coordinates, where each
+// level splits every dimension 2^bitsPerDim ways, with the default storage.
+func NewKdTree(dims int, bitsPerDim uint) (*KdTree, error) {
+	return NewKdTreeWithConfig(dims, bitsPerDim, DefaultConfig)
+}
+
+// NewKdTreeWithConfig is NewKdTree with the bits stored in the backends of
+// config. The layer definitions of config are unused, as dims and bitsPerDim
+// set the size of the blocks.
+func NewKdTreeWithConfig(dims int, bitsPerDim uint, config Config) (*KdTree, error) {
+	bits := uint(dims) * bitsPerDim
+	if dims < 1 || bits < 2 || bits > 16 {
+		return nil, fmt.Errorf("unsupported block of %d dimensions by %d bits", dims, bitsPerDim)
+	}
+	treeFunc, err := config.TreeBackend.withDefaults(defaultTreeBackend).newFunc()
+	if err != nil {
+		return nil, err
+	}
+	leafFunc, err := config.CellBackend.withDefaults(defaultLeafBackend).newFunc()
+	if err != nil {
+		return nil, err
+	}
+	return &KdTree{
+		levelBits: levelBits{
+			tbits:  treeFunc(),
+			lbits:  leafFunc(),
+			tBlock: 1 << bits,
+			lBlock: 1 << bits,
+		},
+		dims:       dims,
+		bitsPerDim: bitsPerDim,
+	}, nil
+}
+
+// extent returns the number of values of each coordinate representable by
+// this KdTree.
+func (k *KdTree) extent() int {
+	if k.levels == 0 {
+		return 0
+	}
+	return 1 << (k.bitsPerDim * uint(k.levels+1))
+}
+
+// Add asserts the existence of point, which must have one non-negative
+// coordinate per dimension. The tree will grow to support it if it is
+// larger than the tree.
+func (k *KdTree) Add(point ...int) error {
+	largest, err := k.checkPoint(point)
+	if err != nil {
+		return err
+	}
+	if k.tbits.Len() == 0 {
+		err = k.initTree(largest)
+	} else if largest >= k.extent() {
+		err = k.growTree(largest)
+	}
+	if err != nil {
+		return err
+	}
+	var buf [maxLevels]int
+	_, err = k.setCell(k.cell(point, &buf))
+	return err
+}
+
+// Contains returns whether point is in the tree.
+func (k *KdTree) Contains(point ...int) bool {
+	largest, err := k.checkPoint(point)
+	if err != nil || k.levels == 0 || largest >= k.extent() {
+		return false
+	}
+	var buf [maxLevels]int
+	bitoff, ok := k.findCell(k.cell(point, &buf))
+	return ok && k.lbits.Get(bitoff)
+}
+
+// Match calls fn for every point in the tree that agrees with pattern on
+// each of its non-negative coordinates; negative coordinates match
+// anything. For a K3Tree of triples, Match([]int{s, -1, -1}, fn) finds every
+// triple with subject s. The slice passed to fn is reused between calls.
+func (k *KdTree) Match(pattern []int, fn func(point []int)) {
+	if len(pattern) != k.dims || k.levels == 0 {
+		return
+	}
+	for _, c := range pattern {
+		if c >= k.extent() {
+			return
+		}
+	}
+	k.match(k.levels, 0, make([]int, k.dims), pattern, fn)
+}
+
+func (k *KdTree) match(level, block int, point, pattern []int, fn func(point []int)) {
+	shift := k.bitsPerDim * uint(level)
+	var bits bitarray
+	base := block * k.tBlock
+	levelStart := 0
+	if level == 0 {
+		bits = k.lbits
+	} else {
+		bits = k.tbits
+		levelStart = k.levelOffsets[level]
+		base += levelStart
+	}
+	mask := 1<<k.bitsPerDim - 1
+	for off := 0; off < k.tBlock; off++ {
+		if !bits.Get(base + off) {
+			continue
+		}
+		matches := true
+		for d := 0; d < k.dims; d++ {
+			c := (off >> (k.bitsPerDim * uint(k.dims-1-d))) & mask
+			if pattern[d] >= 0 && (pattern[d]>>shift)&mask != c {
+				matches = false
+				break
+			}
+			point[d] = point[d]&^(mask<<shift) | c<<shift
+		}
+		if !matches {
+			continue
+		}
+		if level == 0 {
+			fn(point)
+		} else {
+			k.match(level-1, bits.Count(levelStart, base+off), point, pattern, fn)
+		}
+	}
+}
+
+// checkPoint validates point, returning its largest coordinate.
+func (k *KdTree) checkPoint(point []int) (int, error) {
+	if len(point) != k.dims {
+		return 0, fmt.Errorf("expected a point of %d dimensions, got %d", k.dims, len(point))
+	}
+	largest := 0
+	for _, c := range point {
+		if c < 0 {
+			return 0, errors.New("coordinates must be non-negative")
+		}
+		largest = max(largest, c)
+	}
+	return largest, nil
+}
+
+// offsetForLayer returns the offset of point within its block on level l,
+// where level 0 is the leaf layer. The first dimension is the most
+// significant.
+func (k *KdTree) offsetForLayer(point []int, l int) int {
+	shift := k.bitsPerDim * uint(l)
+	mask := 1<<k.bitsPerDim - 1
+	off := 0
+	for _, c := range point {
+		off = off<<k.bitsPerDim | (c>>shift)&mask
+	}
+	return off
+}
+
+// cell fills buf with the offsets of point within its block on each level,
+// as levelBits walks them.
+func (k *KdTree) cell(point []int, buf *[maxLevels]int) []int {
+	offsets := buf[:k.levels+1]
+	for l := range offsets {
+		offsets[l] = k.offsetForLayer(point, l)
+	}
+	return offsets
+}
+
+// growTree grows the KdTree to be large enough to represent coordinate size.
+func (k *KdTree) growTree(size int) error {
+	for size >= k.extent() {
+		err := k.addLevel()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// initTree initializes a tree of the appropriate size to hold coordinate
+// size.
+func (k *KdTree) initTree(size int) error {
+	l := 1
+	for size >= 1<<(k.bitsPerDim*uint(l+1)) {
+		l++
+	}
+	return k.initLevels(l)
+}
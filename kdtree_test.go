@@ -0,0 +1,91 @@
+package k2tree
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestK3TreeAddContains(t *testing.T) {
+	sliced := Config{
+		TreeBackend: Backend{Kind: SliceBackend, Index: FenwickIndex},
+		CellBackend: Backend{Kind: ByteSliceBackend},
+	}
+	for x, bitsPerDim := range []uint{1, 2} {
+		config := DefaultConfig
+		if x == 1 {
+			config = sliced
+		}
+		k3, err := NewKdTreeWithConfig(3, bitsPerDim, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := make(map[[3]int]bool)
+		for x := 0; x < 2000; x++ {
+			p := [3]int{rand.Intn(1000), rand.Intn(20), rand.Intn(5000)}
+			err := k3.Add(p[0], p[1], p[2])
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected[p] = true
+		}
+		for p := range expected {
+			if !k3.Contains(p[0], p[1], p[2]) {
+				t.Fatalf("missing point %v", p)
+			}
+		}
+		for x := 0; x < 2000; x++ {
+			p := [3]int{rand.Intn(1000), rand.Intn(20), rand.Intn(5000)}
+			if k3.Contains(p[0], p[1], p[2]) != expected[p] {
+				t.Fatalf("wrong answer for %v", p)
+			}
+		}
+
+		for _, pattern := range [][]int{
+			{-1, -1, -1},
+			{17, -1, -1},
+			{-1, 3, -1},
+			{-1, 3, 4000},
+		} {
+			want := 0
+			for p := range expected {
+				if (pattern[0] < 0 || p[0] == pattern[0]) &&
+					(pattern[1] < 0 || p[1] == pattern[1]) &&
+					(pattern[2] < 0 || p[2] == pattern[2]) {
+					want++
+				}
+			}
+			got := 0
+			k3.Match(pattern, func(point []int) {
+				if !expected[[3]int{point[0], point[1], point[2]}] {
+					t.Errorf("pattern %v matched unknown point %v", pattern, point)
+				}
+				got++
+			})
+			if got != want {
+				t.Errorf("pattern %v: got %d matches, expected %d", pattern, got, want)
+			}
+		}
+	}
+}
+
+func TestKdTreeErrors(t *testing.T) {
+	if _, err := NewKdTree(1, 1); err == nil {
+		t.Error("expected an error for a 2-bit block")
+	}
+	if _, err := NewKdTreeWithConfig(3, 1, Config{TreeBackend: Backend{Kind: BackendKind(99)}}); err == nil {
+		t.Error("expected an error for an unknown backend")
+	}
+	k, err := NewKdTree(4, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := k.Add(1, 2, 3); err == nil {
+		t.Error("expected an error for a short point")
+	}
+	if err := k.Add(1, 2, 3, -4); err == nil {
+		t.Error("expected an error for a negative coordinate")
+	}
+	if k.Contains(1, 2, 3, 4) {
+		t.Error("empty tree contains a point")
+	}
+}
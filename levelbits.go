@@ -0,0 +1,124 @@
+package k2tree
+
+// levelBits holds the bits of a tree of fixed-size blocks: the levels above
+// the leaves in tbits, each level l starting at levelOffsets[l] with the top
+// level at 0, and the leaf blocks in lbits. Each set bit of a level has a
+// block beneath it on the level below, in order.
+//
+// K2Tree and KdTree only differ in which bit of a block a cell is on each
+// level, which they pass to the methods that walk the tree as offsets:
+// offsets[l] is the bit of the cell within its block on level l, where level
+// 0 is the leaves.
+type levelBits struct {
+	tbits        bitarray
+	lbits        bitarray
+	levels       int
+	levelOffsets []int
+	// tBlock and lBlock are the number of bits in a block above the leaves
+	// and in a leaf block.
+	tBlock int
+	lBlock int
+}
+
+// initLevels starts an empty tree with n levels above the leaves, of which
+// only the top has a block.
+func (t *levelBits) initLevels(n int) error {
+	err := t.tbits.Insert(t.tBlock, 0)
+	if err != nil {
+		return err
+	}
+	t.levels = n
+	t.levelOffsets = make([]int, n+1)
+	for x := n - 1; x > 0; x-- {
+		t.levelOffsets[x] = t.tBlock
+	}
+	return nil
+}
+
+// addLevel puts a new top level on the tree, whose one block leads to the
+// old top block through its first bit.
+func (t *levelBits) addLevel() error {
+	err := t.tbits.Insert(t.tBlock, 0)
+	if err != nil {
+		return err
+	}
+	t.tbits.Set(0, true)
+	for x := len(t.levelOffsets) - 1; x > 0; x-- {
+		t.levelOffsets[x] += t.tBlock
+	}
+	t.levelOffsets = append(t.levelOffsets, 0)
+	t.levels++
+	return nil
+}
+
+// insertBlocks inserts n new blocks in layer l, to be the at-th to
+// (at+n-1)-th blocks of the layer, in a single Insert.
+func (t *levelBits) insertBlocks(l, at, n int) error {
+	if l == 0 {
+		return t.lbits.Insert(n*t.lBlock, at*t.lBlock)
+	}
+	err := t.tbits.Insert(n*t.tBlock, at*t.tBlock+t.levelOffsets[l])
+	if err != nil {
+		return err
+	}
+	for x := l - 1; x > 0; x-- {
+		t.levelOffsets[x] += n * t.tBlock
+	}
+	return nil
+}
+
+// maxLevels bounds the number of levels of a tree, leaves included, as every
+// level above the leaves splits an index at least one more bit.
+const maxLevels = 64
+
+// setCell sets the leaf bit of the cell at offsets, adding the blocks that
+// lead to it, and reports whether the bit was newly set.
+func (t *levelBits) setCell(offsets []int) (added bool, err error) {
+	bitoff, err := t.reserveCell(offsets)
+	if err != nil || t.lbits.Get(bitoff) {
+		return false, err
+	}
+	t.lbits.Set(bitoff, true)
+	return true, nil
+}
+
+// reserveCell adds the blocks that lead to the cell at offsets, without
+// setting it, and returns its offset in lbits. Past reserveCell, setting the
+// cell can't fail.
+func (t *levelBits) reserveCell(offsets []int) (bitoff int, err error) {
+	level := t.levels
+	if t.levelOffsets[level] != 0 {
+		panic("top level is not offset 0?")
+	}
+	var count int
+	for ; level != 0; level-- {
+		levelStart := t.levelOffsets[level]
+		bitoff := levelStart + count*t.tBlock + offsets[level]
+		count = t.tbits.Count(levelStart, bitoff)
+		if !t.tbits.Get(bitoff) {
+			// Make room for the new block below before pointing at it, so
+			// that a failed Insert leaves the tree as it was.
+			err := t.insertBlocks(level-1, count, 1)
+			if err != nil {
+				return 0, err
+			}
+			t.tbits.Set(bitoff, true)
+		}
+	}
+	return count*t.lBlock + offsets[0], nil
+}
+
+// findCell returns the offset in lbits of the cell at offsets. ok is false if
+// the leaf block holding the cell doesn't exist.
+func (t *levelBits) findCell(offsets []int) (bitoff int, ok bool) {
+	var count int
+	for level := t.levels; level != 0; level-- {
+		levelStart := t.levelOffsets[level]
+		bitoff := levelStart + count*t.tBlock + offsets[level]
+		if !t.tbits.Get(bitoff) {
+			return 0, false
+		}
+		count = t.tbits.Count(levelStart, bitoff)
+	}
+	return count*t.lBlock + offsets[0], true
+}
@@ -0,0 +1,10 @@
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package k2tree
+
+import "os"
+
+// lockFile does nothing on platforms without flock: files aren't locked.
+func lockFile(f *os.File, exclusive, wait bool) error {
+	return nil
+}
@@ -0,0 +1,114 @@
+package k2tree
+
+import "fmt"
+
+// mappedRankBits is the number of bits between the counts a mappedArray
+// keeps.
+const mappedRankBits = 4096
+
+// mappedArray is a read-only bitarray over packed bits in the data of the
+// pages of a checkpoint, as they're mapped from its file, so that every
+// process reading the file shares them through the page cache. Only the
+// counts that speed up Count are kept on the heap.
+type mappedArray struct {
+	// data holds the data of the pages, each size bytes but the last, and
+	// the bits start at byte start of them.
+	data   [][]byte
+	size   int
+	start  int
+	length int
+	// ranks[x] is the number of set bits before bit x*mappedRankBits.
+	ranks []int
+	total int
+}
+
+var _ bitarray = (*mappedArray)(nil)
+
+// newMappedArray returns a bitarray over length bits packed in data from
+// byte start on, where every page of data but the last holds size bytes.
+func newMappedArray(data [][]byte, size, start, length int) *mappedArray {
+	m := &mappedArray{
+		data:   data,
+		size:   size,
+		start:  start,
+		length: length,
+		ranks:  make([]int, length/mappedRankBits+1),
+	}
+	for x := 1; x < len(m.ranks); x++ {
+		m.ranks[x] = m.ranks[x-1] + m.count((x-1)*mappedRankBits, x*mappedRankBits)
+	}
+	last := (len(m.ranks) - 1) * mappedRankBits
+	m.total = m.ranks[len(m.ranks)-1] + m.count(last, length)
+	return m
+}
+
+func (m *mappedArray) Len() int {
+	return m.length
+}
+
+func (m *mappedArray) Set(at int, val bool) {
+	panic("can't set a bit of a read-only bitarray")
+}
+
+func (m *mappedArray) Insert(n, at int) error {
+	return ErrReadOnly
+}
+
+// byteAt returns byte n of the bits.
+func (m *mappedArray) byteAt(n int) byte {
+	off := m.start + n
+	return m.data[off/m.size][off%m.size]
+}
+
+func (m *mappedArray) Get(at int) bool {
+	if at < 0 || at >= m.length {
+		panic("out of range")
+	}
+	return m.byteAt(at>>3)&(0x80>>uint(at&0x07)) != 0
+}
+
+func (m *mappedArray) Count(from, to int) int {
+	if from > to {
+		from, to = to, from
+	}
+	if from < 0 || to > m.length {
+		panic("out of range")
+	}
+	return m.rank(to) - m.rank(from)
+}
+
+// rank returns the number of set bits before bit at.
+func (m *mappedArray) rank(at int) int {
+	x := at / mappedRankBits
+	return m.ranks[x] + m.count(x*mappedRankBits, at)
+}
+
+// count counts the set bits in [from, to) without the ranks.
+func (m *mappedArray) count(from, to int) int {
+	c := 0
+	for ; from < to && from&0x07 != 0; from++ {
+		if m.Get(from) {
+			c++
+		}
+	}
+	for ; to > from && to&0x07 != 0; to-- {
+		if m.Get(to - 1) {
+			c++
+		}
+	}
+	for off, end := m.start+from>>3, m.start+to>>3; off < end; {
+		page := m.data[off/m.size][off%m.size:]
+		n := min(len(page), end-off)
+		c += int(countBytes(page[:n]))
+		off += n
+	}
+	return c
+}
+
+func (m *mappedArray) Total() int {
+	return m.total
+}
+
+func (m *mappedArray) debug() string {
+	return fmt.Sprintf("mappedArray L%d T%d, %d pages from byte %d", m.length, m.total, len(m.data), m.start)
+}
@@ -0,0 +1,47 @@
+package k2tree
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestMappedArray(t *testing.T) {
+	const size = 1000
+	expected := newSliceArray()
+	length := 3*mappedRankBits + 4*123
+	expected.Insert(length, 0)
+	for x := 0; x < length/3; x++ {
+		expected.Set(rand.Intn(length), true)
+	}
+	// Start the bits partway into the first page, and split them over pages
+	// that don't line up with the ranks.
+	packed := appendBits(make([]byte, 17), expected)
+	var data [][]byte
+	for len(packed) > size {
+		data = append(data, packed[:size])
+		packed = packed[size:]
+	}
+	data = append(data, packed)
+	m := newMappedArray(data, size, 17, length)
+
+	if m.Len() != length || m.Total() != expected.Total() {
+		t.Fatalf("expected %d bits with %d set, got %d with %d", length, expected.Total(), m.Len(), m.Total())
+	}
+	for at := 0; at < length; at++ {
+		if m.Get(at) != expected.Get(at) {
+			t.Fatalf("bit %d differs", at)
+		}
+	}
+	for x := 0; x < 1000; x++ {
+		from, to := rand.Intn(length+1), rand.Intn(length+1)
+		if m.Count(from, to) != expected.Count(from, to) {
+			t.Fatalf("expected %d bits set in [%d, %d), got %d", expected.Count(from, to), from, to, m.Count(from, to))
+		}
+	}
+	if m.Count(0, length) != expected.Total() {
+		t.Error("wrong count of the whole array")
+	}
+	if m.Insert(4, 0) != ErrReadOnly {
+		t.Error("expected ErrReadOnly inserting into a mapped array")
+	}
+}
@@ -0,0 +1,129 @@
+package k2tree
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+)
+
+/*
+Metadata Layout:
+
+The user metadata of a pagefile holds key/value pairs, sorted by key:
+
+	KeyLen (uvarint)
+	Key (KeyLen B)
+	ValueLen (uvarint)
+	Value (ValueLen B)
+	...
+*/
+
+// ErrMetadataReset is returned by SetMetadata when it wrote over corrupt
+// metadata. The write succeeded, but the metadata holds only the key that
+// was set: the others were lost.
+var ErrMetadataReset = errors.New("k2tree: corrupt metadata was replaced")
+
+// Metadata returns the key/value pairs stored alongside a persistent tree,
+// such as its name, a build timestamp, or the Config it was built with. It
+// returns ErrMetadataCorrupt if the metadata can't be read.
+func (k *K2Tree) Metadata() (map[string][]byte, error) {
+	if k.store == nil {
+		return nil, ErrNotPersistent
+	}
+	b, err := k.store.pf.userMetadata()
+	if err != nil {
+		return nil, err
+	}
+	return decodeMetadata(b)
+}
+
+// SetMetadata stores value under key in the metadata of a persistent tree,
+// replacing any value already there. A nil value deletes key. Keys and
+// values are stored together in at most MaxMetadataSize bytes, and
+// ErrMetadataTooLarge is returned if they wouldn't fit.
+//
+// Metadata is written in place, and is made durable by the next Checkpoint
+// or Close, even if the tree hasn't changed, or straight away for trees
+// opened with SyncAlways. A write that's torn by a crash leaves metadata
+// that Metadata reports as corrupt; SetMetadata then starts over from empty
+// metadata, so that it can be written again, and returns ErrMetadataReset
+// once it's written to say that the other keys were lost.
+func (k *K2Tree) SetMetadata(key string, value []byte) error {
+	err := k.writable()
+	if err != nil {
+		return err
+	}
+	md, err := k.Metadata()
+	reset := err == ErrMetadataCorrupt
+	if reset {
+		md = make(map[string][]byte)
+	} else if err != nil {
+		return err
+	}
+	if value == nil {
+		delete(md, key)
+	} else {
+		md[key] = value
+	}
+	b := encodeMetadata(md)
+	if len(b) > MaxMetadataSize {
+		return ErrMetadataTooLarge
+	}
+	err = k.store.pf.setUserMetadata(b)
+	if err != nil {
+		return err
+	}
+	k.store.unsynced = true
+	if k.store.options.Sync == SyncAlways {
+		err = k.store.syncMetadata()
+		if err != nil {
+			return err
+		}
+	}
+	if reset {
+		return ErrMetadataReset
+	}
+	return nil
+}
+
+func encodeMetadata(md map[string][]byte) []byte {
+	keys := make([]string, 0, len(md))
+	for key := range md {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var out []byte
+	var buf [binary.MaxVarintLen64]byte
+	for _, key := range keys {
+		n := binary.PutUvarint(buf[:], uint64(len(key)))
+		out = append(append(out, buf[:n]...), key...)
+		n = binary.PutUvarint(buf[:], uint64(len(md[key])))
+		out = append(append(out, buf[:n]...), md[key]...)
+	}
+	return out
+}
+
+func decodeMetadata(b []byte) (map[string][]byte, error) {
+	md := make(map[string][]byte)
+	next := func() ([]byte, bool) {
+		n, size := binary.Uvarint(b)
+		if size <= 0 || n > uint64(len(b)-size) {
+			return nil, false
+		}
+		v := b[size : size+int(n)]
+		b = b[size+int(n):]
+		return v, true
+	}
+	for len(b) != 0 {
+		key, ok := next()
+		if !ok {
+			return nil, ErrMetadataCorrupt
+		}
+		value, ok := next()
+		if !ok {
+			return nil, ErrMetadataCorrupt
+		}
+		md[string(key)] = value
+	}
+	return md, nil
+}
@@ -0,0 +1,139 @@
+package k2tree
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMetadata(t *testing.T) {
+	path, cleanup := tempTreePath(t)
+	defer cleanup()
+	k, err := Open(path, testOpenOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	md, err := k.Metadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(md) != 0 {
+		t.Fatalf("new tree has metadata %v", md)
+	}
+	err = k.SetMetadata("name", []byte("roads"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = k.SetMetadata("built", []byte("2019-10-27"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = k.SetMetadata("empty", []byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = k.SetMetadata("built", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = k.SetMetadata("big", make([]byte, MaxMetadataSize))
+	if err != ErrMetadataTooLarge {
+		t.Fatalf("expected ErrMetadataTooLarge, got %v", err)
+	}
+	err = k.Checkpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The tree is unchanged since its last checkpoint, but the metadata
+	// still has to be synced.
+	err = k.SetMetadata("name", []byte("roads"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq := k.store.live.Seq
+	err = k.Checkpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.store.live.Seq != seq || k.store.unsynced {
+		t.Error("Checkpoint didn't just sync the metadata of an unchanged tree")
+	}
+	err = k.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Verify(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := OpenReadOnly(path, testOpenOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	md, err = r.Metadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(md) != 2 || !bytes.Equal(md["name"], []byte("roads")) || md["empty"] == nil {
+		t.Fatalf("unexpected metadata %v", md)
+	}
+	if r.SetMetadata("name", nil) != ErrReadOnly {
+		t.Error("expected ErrReadOnly setting metadata on a reader")
+	}
+
+	m, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Metadata(); err != ErrNotPersistent {
+		t.Errorf("expected ErrNotPersistent, got %v", err)
+	}
+	if err := m.SetMetadata("name", []byte("roads")); err != ErrNotPersistent {
+		t.Errorf("expected ErrNotPersistent setting metadata, got %v", err)
+	}
+}
+
+func TestMetadataCorrupt(t *testing.T) {
+	path, cleanup := tempTreePath(t)
+	defer cleanup()
+	k, err := Open(path, testOpenOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = k.SetMetadata("name", []byte("roads"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.store.pf.bytes[userMetadataOffset+10] ^= 0xFF
+	if _, err := k.Metadata(); err != ErrMetadataCorrupt {
+		t.Errorf("expected ErrMetadataCorrupt, got %v", err)
+	}
+	err = k.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectCorrupt(t, path, "user metadata")
+
+	// Writing over corrupt metadata starts it over, and says so.
+	k, err = Open(path, testOpenOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer k.Close()
+	err = k.SetMetadata("built", []byte("today"))
+	if err != ErrMetadataReset {
+		t.Fatalf("expected ErrMetadataReset, got %v", err)
+	}
+	md, err := k.Metadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(md) != 1 || !bytes.Equal(md["built"], []byte("today")) {
+		t.Errorf("unexpected metadata %q after writing over corrupt metadata", md)
+	}
+	err = k.SetMetadata("name", []byte("roads"))
+	if err != nil {
+		t.Fatalf("expected no error setting metadata once it's been reset, got %v", err)
+	}
+}
@@ -0,0 +1,112 @@
+package k2tree
+
+import "math"
+
+// valueRange is the span of some per-link quantity below a node of the tree.
+type valueRange struct {
+	min int
+	max int
+}
+
+var emptyRange = valueRange{min: math.MaxInt64, max: math.MinInt64}
+
+func (r valueRange) merge(o valueRange) valueRange {
+	return valueRange{min: min(r.min, o.min), max: max(r.max, o.max)}
+}
+
+func (r valueRange) overlaps(lo, hi int) bool {
+	return r.min <= hi && r.max >= lo
+}
+
+// nodeRanges computes, for each level above the leaves, the range spanned by
+// the links below each set bit on that level, in order. leaf returns the
+// range of the link whose leaf bit has the given rank. The n-th set bit of a
+// level points at the n-th block of the level below, so each level is a
+// single pass over the one beneath it.
+func (k *K2Tree) nodeRanges(leaf func(rank int) valueRange) [][]valueRange {
+	ranges := make([][]valueRange, k.levels+1)
+	var below []valueRange
+	rank := 0
+	for base := 0; base < k.lbits.Len(); base += k.lk.bitsPerLayer {
+		r := emptyRange
+		for off := 0; off < k.lk.bitsPerLayer; off++ {
+			if k.lbits.Get(base + off) {
+				r = r.merge(leaf(rank))
+				rank++
+			}
+		}
+		below = append(below, r)
+	}
+	for l := 1; l <= k.levels; l++ {
+		ranges[l] = below
+		if l == k.levels {
+			break
+		}
+		end := k.levelOffsets[l-1]
+		if l == 1 {
+			end = k.tbits.Len()
+		}
+		var next []valueRange
+		n := 0
+		for base := k.levelOffsets[l]; base < end; base += k.tk.bitsPerLayer {
+			r := emptyRange
+			for off := 0; off < k.tk.bitsPerLayer; off++ {
+				if k.tbits.Get(base + off) {
+					r = r.merge(below[n])
+					n++
+				}
+			}
+			next = append(next, r)
+		}
+		below = next
+	}
+	return ranges
+}
+
+// walkRanges calls fn with the position and leaf rank of every link in the
+// tree, skipping the nodes whose range, as computed by nodeRanges, keep
+// rejects.
+func (k *K2Tree) walkRanges(ranges [][]valueRange, keep func(valueRange) bool, fn func(i, j, rank int)) {
+	if k.levels == 0 {
+		return
+	}
+	k.walkRangesOnLevel(k.levels, 0, 0, 0, ranges, keep, fn)
+}
+
+func (k *K2Tree) walkRangesOnLevel(level, block, i, j int, ranges [][]valueRange, keep func(valueRange) bool, fn func(i, j, rank int)) {
+	if level == 0 {
+		base := block * k.lk.bitsPerLayer
+		rank := k.lbits.Count(0, base)
+		for off := 0; off < k.lk.bitsPerLayer; off++ {
+			if k.lbits.Get(base + off) {
+				fn(i+(off>>k.lk.shiftPerLayer), j+(off&k.lk.maskPerLayer), rank)
+				rank++
+			}
+		}
+		return
+	}
+	s := k.shapes[level]
+	levelStart := k.levelOffsets[level]
+	base := levelStart + block*k.tk.bitsPerLayer
+	for off := 0; off < k.tk.bitsPerLayer; off++ {
+		if !k.tbits.Get(base + off) {
+			continue
+		}
+		count := k.tbits.Count(levelStart, base+off)
+		if !keep(ranges[level][count]) {
+			continue
+		}
+		x := off >> s.colBits
+		y := off & (1<<s.colBits - 1)
+		k.walkRangesOnLevel(level-1, count, i+x<<s.rowShift, j+y<<s.colShift, ranges, keep, fn)
+	}
+}
+
+// leafRank returns the rank among the set leaf bits of the link from i to j.
+func (k *K2Tree) leafRank(i, j int) (int, bool) {
+	bitoff, ok := k.findLeaf(i, j)
+	if !ok || !k.lbits.Get(bitoff) {
+		return 0, false
+	}
+	return k.lbits.Count(0, bitoff), true
+}
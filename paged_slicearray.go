@@ -2,13 +2,16 @@ package k2tree
 
 import (
 	"fmt"
-
-	popcount "github.com/tmthrgd/go-popcount"
 )
 
 type pagedSliceArray struct {
 	arrays   []*sliceArray
 	pagesize int
+	// refs counts the snapshots holding each array, and shared marks the
+	// arrays that were held by a snapshot when they were last written to.
+	// Both are nil until the first snapshot.
+	refs   *pageRefs
+	shared []bool
 }
 
 var _ bitarray = (*pagedSliceArray)(nil)
@@ -40,9 +43,10 @@ func (p *pagedSliceArray) Total() int {
 }
 
 func (p *pagedSliceArray) Set(at int, val bool) {
-	for _, x := range p.arrays {
+	for i, x := range p.arrays {
 		if x.length > at {
-			x.Set(at, val)
+			p.own(i)
+			p.arrays[i].Set(at, val)
 			return
 		}
 		at -= x.length
@@ -102,6 +106,8 @@ func (p *pagedSliceArray) Insert(n int, at int) error {
 		}
 		at -= x.length
 	}
+	p.own(pagei)
+	page = p.arrays[pagei]
 	if page.length < p.pagesize {
 		return page.Insert(n, at)
 	}
@@ -111,12 +117,15 @@ func (p *pagedSliceArray) Insert(n int, at int) error {
 	newpage := &sliceArray{
 		bytes:  newbytes,
 		length: l * 8,
-		total:  int(popcount.CountBytes(page.bytes[:l])),
+		total:  int(countBytes(page.bytes[:l])),
 	}
 	page.bytes = page.bytes[l:]
 	page.length -= l * 8
 	page.total -= newpage.total
 	p.arrays = append(p.arrays[:pagei], append([]*sliceArray{newpage}, p.arrays[pagei:]...)...)
+	if p.shared != nil {
+		p.shared = append(p.shared[:pagei], append([]bool{false}, p.shared[pagei:]...)...)
+	}
 	return p.Insert(n, origat)
 }
 
@@ -4,8 +4,6 @@ import (
 	"fmt"
 	"math"
 	"math/bits"
-
-	popcount "github.com/tmthrgd/go-popcount"
 )
 
 type pagedBitarray struct {
@@ -19,6 +17,11 @@ type pagedBitarray struct {
 	high          int
 	low           int
 	bittotal      int
+	// refs counts the snapshots holding each page, and shared marks the
+	// levels whose pages were held by a snapshot when they were last
+	// written to. Both are nil until the first snapshot.
+	refs   *pageRefs
+	shared []bool
 }
 
 var _ bitarray = (*pagedBitarray)(nil)
@@ -44,6 +47,7 @@ func (p *pagedBitarray) Set(at int, val bool) {
 	bit := byte(at & 0x07)
 	t := byte(0x01 << (7 - bit))
 	level, byteoff := p.findOffset(off)
+	p.own(level)
 	orig := p.pages[level][byteoff]
 	var newbyte byte
 	if val {
@@ -108,14 +112,14 @@ func (p *pagedBitarray) Count(from, to int) int {
 	}
 
 	if startl == endl {
-		c += popcount.CountBytes(p.pages[startl][startoff:endoff])
+		c += countBytes(p.pages[startl][startoff:endoff])
 		return int(c)
 	}
 
-	c += popcount.CountBytes(p.pages[startl][startoff:p.levelLength[startl]])
-	c += popcount.CountBytes(p.pages[endl][:endoff])
+	c += countBytes(p.pages[startl][startoff:p.levelLength[startl]])
+	c += countBytes(p.pages[endl][:endoff])
 	for l := startl + 1; l < endl; l++ {
-		c += popcount.CountBytes(p.pages[l][:p.levelLength[l]])
+		c += countBytes(p.pages[l][:p.levelLength[l]])
 	}
 	return int(c)
 }
@@ -170,6 +174,7 @@ func (p *pagedBitarray) insertFour(at int) error {
 
 	level, byteoff := p.findOffset(off)
 	if at%8 != 0 {
+		p.own(level)
 		inbyte = p.pages[level][byteoff]
 		p.pages[level][byteoff] = inbyte & 0xF0
 		byteoff++
@@ -182,6 +187,7 @@ func (p *pagedBitarray) insertFour(at int) error {
 	inbyte = inbyte << 4
 
 	for l := level; l < len(p.pages); l++ {
+		p.own(l)
 		inbyte = insertFourBits(p.pages[l][byteoff:p.levelLength[l]], inbyte)
 		byteoff = 0
 	}
@@ -260,6 +266,7 @@ func (p *pagedBitarray) updateTree(level, delta int) {
 
 func (p *pagedBitarray) setByte(idx int, b byte) {
 	level, off := p.findOffset(idx)
+	p.own(level)
 	p.pages[level][off] = b
 }
 
@@ -314,6 +321,7 @@ func (p *pagedBitarray) insertBytes(idx int, b []byte) {
 
 func (p *pagedBitarray) insertIntoLevel(level int, idx int, b []byte) {
 	amt := len(b)
+	p.own(level)
 	copy(p.pages[level][idx+amt:p.levelLength[level]+amt], p.pages[level][idx:p.levelLength[level]])
 	copy(p.pages[level][idx:], b)
 	p.bytelength += amt
@@ -340,6 +348,8 @@ func (p *pagedBitarray) rebalance() {
 				panic(fmt.Sprintf("l: %d, is under low water", l))
 			}
 			toMove := min(overlow, p.levelFree(l+1))
+			p.own(l)
+			p.own(l + 1)
 			copy(p.pages[l+1][toMove:], p.pages[l+1][:p.levelLength[l+1]])
 			copy(p.pages[l+1][:toMove], p.pages[l][p.levelLength[l]-toMove:p.levelLength[l]])
 			p.levelLength[l+1] += toMove
@@ -374,6 +384,9 @@ func (p *pagedBitarray) createNewLevel() {
 	}
 	p.pages = append(p.pages, make([]byte, p.pagesize))
 	p.levelLength = append(p.levelLength, 0)
+	if p.shared != nil {
+		p.shared = append(p.shared, false)
+	}
 }
 
 func (p *pagedBitarray) levelFree(l int) int {
@@ -3,17 +3,26 @@ package k2tree
 import (
 	"encoding/binary"
 	"errors"
+	"hash/crc32"
 	"os"
 
 	mmap "github.com/barakmich/mmap-go"
 )
 
 type pagefile struct {
-	bytes    mmap.MMap
-	file     *os.File
-	filelen  int
+	bytes   mmap.MMap
+	file    *os.File
+	filelen int
+	// mapped is the length of the mapping, which may be more than
+	// len(bytes) if the file has shrunk since it was mapped.
+	mapped   int
 	pages    int
 	pagesize int
+	// free are the pages that hold nothing, sorted.
+	free []extent
+	// readOnly is set on pagefiles mapped with read-only protection, which
+	// mustn't be written to.
+	readOnly bool
 }
 
 /*
@@ -25,8 +34,17 @@ Header
 	PageSize (8B/int64)
 	N-Pages (8B/int64)
 	PagefileDataReserve
+	----4KiB-------------------
+	RootSlot0
+	----8KiB-------------------
+	RootSlot1
+	----12KiB------------------
+	FreeList (see freelist.go)
 	----32KiB------------------
 	PagefileUserMetadata
+		Length (4B/uint32)
+		Checksum (4B, CRC32C of Bytes)
+		Bytes (Length B)
 ----128KiB-----------------
 Page0
 ----128KiB + PageSize------
@@ -39,6 +57,7 @@ Page Layout:
 
 ----0----------------------
 PageHeader
+	Checksum (4B, CRC32C of PageBytes)
 ----4KiB-------------------
 PageBytes
 ----PageSize---------------
@@ -53,15 +72,31 @@ const (
 	headerSize         = 128 * 1024
 	userMetadataOffset = 32 * 1024
 	DefaultPagesize    = 512 * 1024
+
+	// MaxMetadataSize is the most user metadata a pagefile can hold.
+	MaxMetadataSize = headerSize - userMetadataOffset - 8
 )
 
+// ErrMetadataTooLarge is returned when user metadata doesn't fit in the
+// MaxMetadataSize bytes set aside for it.
+var ErrMetadataTooLarge = errors.New("k2tree: metadata is too large")
+
+// ErrMetadataCorrupt is returned when user metadata is truncated or fails its
+// checksum, as a write to it that's torn by a crash leaves it.
+var ErrMetadataCorrupt = errors.New("k2tree: metadata is corrupt")
+
+// ErrLocked is returned when opening a pagefile that another process has
+// locked: for writing, when any other process has it open, and for reading,
+// when another process has it open for writing.
+var ErrLocked = errors.New("k2tree: pagefile is locked by another process")
+
 var (
 	// magicHeader identifies the file and are the first bytes written in the header
 	// page. The whole of the header is 128KiB, most of which (96KiB) is for users of the page file
 	// (ie, the K2 bitarray/pagefile interface) and the front part of which is for bookkeeping in the pagefile itself.
-	// It also identifies the version. The versions are immutable, and a converter
-	// must be run if it changes.
-	magicHeader = []byte{'K', '2', 'B', 'P', 'v', '1', 0x00, 0x00}
+	// It also identifies the version. The versions are immutable, and Upgrade
+	// must be run on files of older versions; see formats.
+	magicHeader = magicFor(currentVersion)
 )
 
 type header struct {
@@ -70,25 +105,6 @@ type header struct {
 	Pages    int64
 }
 
-func createPagefile(filename string, pagesize int) (*pagefile, error) {
-	f, err := os.Create(filename)
-	if err != nil {
-		return nil, err
-	}
-	err = f.Truncate(headerSize)
-	if err != nil {
-		return nil, err
-	}
-	var h header
-	h.PageSize = int64(pagesize)
-	writeHeader(h, f)
-	err = f.Close()
-	if err != nil {
-		return nil, err
-	}
-	return openPagefile(filename)
-}
-
 func writeHeader(h header, f *os.File) error {
 	for i, b := range magicHeader {
 		h.Magic[i] = b
@@ -98,10 +114,13 @@ func writeHeader(h header, f *os.File) error {
 }
 
 func (s *pagefile) Close() error {
-	err := s.bytes.Unmap()
+	err := s.unmap()
 	if err != nil {
 		return err
 	}
+	if s.readOnly {
+		return s.file.Close()
+	}
 	var h header
 	h.PageSize = int64(s.pagesize)
 	h.Pages = int64(s.pages)
@@ -112,46 +131,351 @@ func (s *pagefile) Close() error {
 	return s.file.Close()
 }
 
-func openPagefile(filename string) (*pagefile, error) {
-	f, err := os.OpenFile(filename, os.O_RDWR, 0666)
+// openPagefile opens and maps an existing pagefile. A read-only pagefile is
+// mapped with read-only protection, so it can be opened on read-only files.
+//
+// The file is locked while it's open: shared for reading, and exclusive
+// otherwise. If wait is false and the lock is held elsewhere, ErrLocked is
+// returned rather than waiting for it.
+func openPagefile(filename string, readOnly, wait bool) (*pagefile, error) {
+	flag := os.O_RDWR
+	if readOnly {
+		flag = os.O_RDONLY
+	}
+	f, err := os.OpenFile(filename, flag, 0666)
 	if err != nil {
 		return nil, err
 	}
+	err = lockFile(f, !readOnly, wait)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return mapPagefile(f, readOnly)
+}
+
+// mapPagefile checks the header of the pagefile f and maps it. f is closed
+// if it fails.
+func mapPagefile(f *os.File, readOnly bool) (*pagefile, error) {
+	prot := mmap.RDWR
+	if readOnly {
+		prot = mmap.RDONLY
+	}
 	var h header
-	err = binary.Read(f, binary.BigEndian, &h)
+	_, err := f.Seek(0, 0)
+	if err == nil {
+		err = binary.Read(f, binary.BigEndian, &h)
+	}
 	if err != nil {
+		f.Close()
 		return nil, err
 	}
-	for i, b := range magicHeader {
-		if b != h.Magic[i] {
-			return nil, errors.New("incompatible magic header")
-		}
+	err = checkVersion(h.Magic)
+	if err != nil {
+		f.Close()
+		return nil, err
 	}
 	fi, err := f.Stat()
 	if err != nil {
+		f.Close()
 		return nil, err
 	}
 	f.Seek(0, 0)
-	m, err := mmap.Map(f, mmap.RDWR, 0)
+	m, err := mmap.Map(f, prot, 0)
 	if err != nil {
+		f.Close()
 		return nil, err
 	}
-	return &pagefile{
+	s := &pagefile{
 		bytes:    m,
 		pages:    int(h.Pages),
 		pagesize: int(h.PageSize),
 		file:     f,
 		filelen:  int(fi.Size()),
-	}, nil
+		mapped:   int(fi.Size()),
+		readOnly: readOnly,
+	}
+	if !readOnly {
+		s.readFreeList()
+	}
+	return s, nil
+}
+
+// pageData returns the bytes of page n that follow its PageHeader.
+func (s *pagefile) pageData(n int) []byte {
+	off := headerSize + n*s.pagesize
+	return s.bytes[off+blockSize : off+s.pagesize]
+}
+
+// dataSize returns the number of bytes each page can hold.
+func (s *pagefile) dataSize() int {
+	return s.pagesize - blockSize
+}
+
+// setPages grows or shrinks the file to hold n pages. Within the length
+// that's mapped, the file is truncated and the mapping resized in place with
+// MMap.Truncate; growing past it maps the file anew.
+func (s *pagefile) setPages(n int) error {
+	if n == s.pages {
+		return nil
+	}
+	size := headerSize + n*s.pagesize
+	if size <= s.mapped {
+		err := s.bytes.Truncate(s.file, size)
+		if err != nil {
+			return err
+		}
+	} else {
+		// The file is grown before it's unmapped, so that a file that can't
+		// grow is left mapped as it was.
+		err := s.file.Truncate(int64(size))
+		if err != nil {
+			return err
+		}
+		err = s.unmap()
+		if err != nil {
+			return err
+		}
+		m, err := mmap.Map(s.file, mmap.RDWR, 0)
+		if err != nil {
+			return err
+		}
+		s.bytes = m
+		s.mapped = size
+	}
+	s.filelen = size
+	s.pages = n
+	var h header
+	h.PageSize = int64(s.pagesize)
+	h.Pages = int64(s.pages)
+	return writeHeader(h, s.file)
+}
+
+// unmap unmaps the whole of the file, which may be mapped past the end of
+// s.bytes if it has shrunk.
+func (s *pagefile) unmap() error {
+	err := s.bytes.Truncate(nil, s.mapped)
+	if err != nil {
+		return err
+	}
+	return s.bytes.Unmap()
 }
 
-func newPagefile(filename string, pagesize int) (*pagefile, error) {
-	_, err := os.Stat(filename)
+// sync flushes the mapped file to disk.
+func (s *pagefile) sync() error {
+	err := s.bytes.Flush()
 	if err != nil {
-		if os.IsNotExist(err) {
-			return createPagefile(filename, pagesize)
+		return err
+	}
+	return s.file.Sync()
+}
+
+// rootSlotOffsets are where the two root slots live in the header. Each has
+// a block to itself, so that a torn write to one can't touch the other.
+var rootSlotOffsets = [2]int{blockSize, 2 * blockSize}
+
+// rootSlot points at a checkpointed image of a tree, which fills the data of
+// the pages [StartPage, StartPage+NumPages). Checkpoints alternate between
+// the two slots, and the valid slot with the highest Seq is the current one,
+// so a checkpoint only takes effect once its slot is completely written.
+type rootSlot struct {
+	Seq       uint64
+	LSN       uint64
+	StartPage int64
+	NumPages  int64
+	ImageLen  int64
+	ImageCRC  uint32
+	CRC       uint32
+}
+
+const rootSlotSize = 8*5 + 4 + 4
+
+func (r rootSlot) checksum() uint32 {
+	var buf [rootSlotSize]byte
+	r.encode(buf[:])
+	return crc32.Checksum(buf[:rootSlotSize-4], castagnoli)
+}
+
+func (r rootSlot) encode(b []byte) {
+	binary.BigEndian.PutUint64(b[0:], r.Seq)
+	binary.BigEndian.PutUint64(b[8:], r.LSN)
+	binary.BigEndian.PutUint64(b[16:], uint64(r.StartPage))
+	binary.BigEndian.PutUint64(b[24:], uint64(r.NumPages))
+	binary.BigEndian.PutUint64(b[32:], uint64(r.ImageLen))
+	binary.BigEndian.PutUint32(b[40:], r.ImageCRC)
+	binary.BigEndian.PutUint32(b[44:], r.CRC)
+}
+
+func decodeRootSlot(b []byte) rootSlot {
+	return rootSlot{
+		Seq:       binary.BigEndian.Uint64(b[0:]),
+		LSN:       binary.BigEndian.Uint64(b[8:]),
+		StartPage: int64(binary.BigEndian.Uint64(b[16:])),
+		NumPages:  int64(binary.BigEndian.Uint64(b[24:])),
+		ImageLen:  int64(binary.BigEndian.Uint64(b[32:])),
+		ImageCRC:  binary.BigEndian.Uint32(b[40:]),
+		CRC:       binary.BigEndian.Uint32(b[44:]),
+	}
+}
+
+// roots returns the valid root slots, newest first.
+func (s *pagefile) roots() []rootSlot {
+	return validRoots(s.bytes, s.pages, s.dataSize())
+}
+
+// validRoots returns the valid root slots in the file header hdr, newest
+// first, given the number of pages in the file and the data each holds.
+func validRoots(hdr []byte, pages, dataSize int) []rootSlot {
+	var out []rootSlot
+	for _, off := range rootSlotOffsets {
+		r := decodeRootSlot(hdr[off:])
+		if r.Seq == 0 || r.CRC != r.checksum() {
+			continue
+		}
+		if r.StartPage < 0 || r.NumPages < 0 || r.StartPage+r.NumPages > int64(pages) ||
+			r.ImageLen < 0 || r.ImageLen > r.NumPages*int64(dataSize) {
+			continue
 		}
+		out = append(out, r)
+	}
+	if len(out) == 2 && out[1].Seq > out[0].Seq {
+		out[0], out[1] = out[1], out[0]
+	}
+	return out
+}
+
+// writeRoot writes r to the slot it belongs in, by its Seq.
+func (s *pagefile) writeRoot(r rootSlot) {
+	r.CRC = r.checksum()
+	r.encode(s.bytes[rootSlotOffsets[r.Seq%2]:])
+}
+
+// clearRoot invalidates the root slot that a root of sequence number seq
+// is written to.
+func (s *pagefile) clearRoot(seq uint64) {
+	var zero [rootSlotSize]byte
+	copy(s.bytes[rootSlotOffsets[seq%2]:], zero[:])
+}
+
+// page returns all the bytes of page n, header included.
+func (s *pagefile) page(n int) []byte {
+	off := headerSize + n*s.pagesize
+	return s.bytes[off : off+s.pagesize]
+}
+
+// pageValid returns whether page, header included, matches its checksum.
+func pageValid(page []byte) bool {
+	return binary.BigEndian.Uint32(page) == crc32.Checksum(page[blockSize:], castagnoli)
+}
+
+// sealPage writes the checksum of page into its header.
+func sealPage(page []byte) {
+	binary.BigEndian.PutUint32(page, crc32.Checksum(page[blockSize:], castagnoli))
+}
+
+// imageData returns the data of the pages that hold the image r points to,
+// as they're mapped, with the last cut off where the image ends, or false if
+// the image or any of its pages fails its checksum.
+func (s *pagefile) imageData(r rootSlot) ([][]byte, bool) {
+	var out [][]byte
+	var crc uint32
+	for p, left := int(r.StartPage), int(r.ImageLen); left > 0; p++ {
+		if !pageValid(s.page(p)) {
+			return nil, false
+		}
+		data := s.pageData(p)
+		data = data[:min(len(data), left)]
+		crc = crc32.Update(crc, castagnoli, data)
+		out = append(out, data)
+		left -= len(data)
+	}
+	return out, crc == r.ImageCRC
+}
+
+// readImage returns a copy of the image r points to, or false if it or any
+// of its pages fails its checksum.
+func (s *pagefile) readImage(r rootSlot) ([]byte, bool) {
+	data, ok := s.imageData(r)
+	if !ok {
+		return nil, false
+	}
+	out := make([]byte, 0, r.ImageLen)
+	for _, d := range data {
+		out = append(out, d...)
+	}
+	return out, true
+}
+
+// writeImage copies image into the data of the pages starting at start,
+// which must exist, and seals them.
+func (s *pagefile) writeImage(start int, image []byte) {
+	for p := start; len(image) > 0; p++ {
+		n := copy(s.pageData(p), image)
+		image = image[n:]
+		sealPage(s.page(p))
+	}
+}
+
+// userMetadata returns a copy of the user metadata, which is empty if it
+// was never set.
+func (s *pagefile) userMetadata() ([]byte, error) {
+	return decodeUserMetadata(s.bytes[userMetadataOffset:headerSize])
+}
+
+func decodeUserMetadata(region []byte) ([]byte, error) {
+	n := int64(binary.BigEndian.Uint32(region))
+	if n > MaxMetadataSize {
+		return nil, ErrMetadataCorrupt
+	}
+	b := region[8 : 8+n]
+	if binary.BigEndian.Uint32(region[4:]) != crc32.Checksum(b, castagnoli) {
+		return nil, ErrMetadataCorrupt
+	}
+	return append([]byte(nil), b...), nil
+}
+
+// setUserMetadata replaces the user metadata with b.
+func (s *pagefile) setUserMetadata(b []byte) error {
+	if len(b) > MaxMetadataSize {
+		return ErrMetadataTooLarge
+	}
+	region := s.bytes[userMetadataOffset:headerSize]
+	binary.BigEndian.PutUint32(region, uint32(len(b)))
+	binary.BigEndian.PutUint32(region[4:], crc32.Checksum(b, castagnoli))
+	copy(region[8:], b)
+	return nil
+}
+
+// newPagefile opens the pagefile at filename for writing, creating it with
+// pages of pagesize bytes if it doesn't exist or is empty. The file is
+// locked exclusively before it's created, so two writers can't both create
+// it; wait is as for openPagefile.
+func newPagefile(filename string, pagesize int, wait bool) (*pagefile, error) {
+	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	err = lockFile(f, true, wait)
+	if err != nil {
+		f.Close()
 		return nil, err
 	}
-	return openPagefile(filename)
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if fi.Size() == 0 {
+		err = f.Truncate(headerSize)
+		if err == nil {
+			var h header
+			h.PageSize = int64(pagesize)
+			err = writeHeader(h, f)
+		}
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return mapPagefile(f, false)
 }
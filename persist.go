@@ -0,0 +1,711 @@
+package k2tree
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+// ErrNotPersistent is returned by the methods that manage the file of a
+// persistent tree when called on a tree that lives only in memory.
+var ErrNotPersistent = errors.New("k2tree: tree is not backed by a file")
+
+// ErrReadOnly is returned by the methods that change a tree when called on a
+// tree opened with OpenReadOnly, or on a Snapshot.
+var ErrReadOnly = errors.New("k2tree: tree is read-only")
+
+// OpenOptions configures a tree opened with Open.
+type OpenOptions struct {
+	// Config configures a newly created tree. When opening an existing tree
+	// only its backends are used, as the layer definitions are part of the
+	// file. A zero layer definition picks the one from DefaultConfig.
+	Config Config
+	// Rectangular creates a new tree as NewRectangular does.
+	Rectangular bool
+	// PageSize is the page size, in bytes, of a newly created file. It must
+	// be a multiple of 4KiB, and larger than it. Zero means DefaultPagesize.
+	PageSize int
+	// Sync is when writes to the log are fsynced.
+	Sync SyncPolicy
+	// CheckpointEvery checkpoints the tree whenever its log holds this many
+	// records. Zero only checkpoints on Checkpoint and Close. The changes
+	// that set off a checkpoint don't fail if it does, as they're logged;
+	// it's tried again after the next change, and Checkpoint and Close
+	// report the error if it persists.
+	CheckpointEvery int
+	// WaitForLock waits for other processes to release the file, rather
+	// than failing with ErrLocked.
+	WaitForLock bool
+}
+
+// treeStore holds the files behind a persistent K2Tree: the pagefile that
+// the tree is checkpointed into, and the write-ahead log of the changes made
+// since the last checkpoint.
+type treeStore struct {
+	pf      *pagefile
+	wal     *wal
+	options OpenOptions
+	// live is the root slot of the current checkpoint; live.Seq is zero if
+	// there isn't one yet.
+	live rootSlot
+	// fallback is the root slot of the checkpoint before it.
+	fallback rootSlot
+	// readOnly is set on trees opened with OpenReadOnly.
+	readOnly bool
+	// rebuilt is set when the tree has been rebuilt by Compact since the
+	// last checkpoint, which changes its bits without logging anything.
+	rebuilt bool
+	// unsynced is set when metadata has been written to the file since it
+	// was last synced.
+	unsynced bool
+}
+
+// Open opens the tree stored at path, creating it if it doesn't exist. The
+// tree is loaded from its last checkpoint, and the changes logged since, in
+// path + ".wal", are replayed on top of it.
+//
+// Every Add and Remove on the returned tree is written to the log before
+// it's applied, so a tree that's reopened after the process dies has every
+// change that was acknowledged, subject to the Sync policy. Close the tree
+// to checkpoint it and release its files.
+//
+// The file is locked exclusively until the tree is closed, so Open returns
+// ErrLocked if any other process has the tree open, unless
+// options.WaitForLock is set. Locks are advisory, and aren't taken on
+// platforms without flock.
+func Open(path string, options OpenOptions) (*K2Tree, error) {
+	return open(path, options, false)
+}
+
+// OpenReadOnly opens the tree stored at path, which must exist, for reading.
+// The file is mapped with read-only protection, so it can live on a
+// read-only volume or belong to another user.
+//
+// Queries are served straight from the pages of the checkpoint, as they're
+// mapped, so every process reading the file shares them through the page
+// cache; only an index of counts over them is kept in memory. If the log
+// holds changes made since the checkpoint, they're replayed onto a copy of
+// it in memory instead, as Open does, and the log is left untouched. Every
+// method that would change the tree returns ErrReadOnly, and Close only
+// releases its files.
+//
+// The file is locked shared until the tree is closed: any number of readers
+// can have it open at once, but OpenReadOnly returns ErrLocked while a
+// writer has it open, unless options.WaitForLock is set.
+func OpenReadOnly(path string, options OpenOptions) (*K2Tree, error) {
+	return open(path, options, true)
+}
+
+func open(path string, options OpenOptions, readOnly bool) (*K2Tree, error) {
+	if options.PageSize == 0 {
+		options.PageSize = DefaultPagesize
+	}
+	if options.PageSize <= blockSize || options.PageSize%blockSize != 0 {
+		return nil, fmt.Errorf("invalid page size %d", options.PageSize)
+	}
+	if options.Config.TreeLayerDef.bitsPerLayer == 0 {
+		options.Config.TreeLayerDef = DefaultConfig.TreeLayerDef
+	}
+	if options.Config.CellLayerDef.bitsPerLayer == 0 {
+		options.Config.CellLayerDef = DefaultConfig.CellLayerDef
+	}
+	var pf *pagefile
+	var err error
+	if readOnly {
+		pf, err = openPagefile(path, true, options.WaitForLock)
+	} else {
+		pf, err = newPagefile(path, options.PageSize, options.WaitForLock)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s := &treeStore{pf: pf, options: options, readOnly: readOnly}
+	k, err := s.load()
+	if err != nil {
+		pf.Close()
+		return nil, err
+	}
+	if readOnly {
+		s.wal, err = openWALReadOnly(path + ".wal")
+	} else {
+		s.wal, err = openWAL(path+".wal", options.Sync)
+	}
+	if err != nil {
+		pf.Close()
+		return nil, err
+	}
+	err = s.wal.replay(s.live.LSN, func(r walRecord) error {
+		if _, ok := k.tbits.(*mappedArray); ok {
+			// The mapped checkpoint can't be changed, so the log is
+			// replayed onto a copy of it.
+			c, err := s.decode()
+			if err != nil {
+				return err
+			}
+			k = c
+		}
+		return k.apply(r)
+	})
+	if err != nil {
+		s.wal.close()
+		pf.Close()
+		return nil, err
+	}
+	k.store = s
+	return k, nil
+}
+
+// load returns the tree of the newest intact checkpoint, or a new tree if
+// there is no checkpoint.
+func (s *treeStore) load() (*K2Tree, error) {
+	roots := s.pf.roots()
+	if len(roots) == 0 {
+		k, err := NewWithConfig(s.options.Config)
+		if err != nil {
+			return nil, err
+		}
+		k.rectangular = s.options.Rectangular
+		return k, nil
+	}
+	for x, r := range roots {
+		data, ok := s.pf.imageData(r)
+		if !ok {
+			continue
+		}
+		s.live = r
+		if x+1 < len(roots) {
+			s.fallback = roots[x+1]
+		}
+		if s.readOnly {
+			return mapImage(data, s.pf.dataSize(), s.options.Config)
+		}
+		return s.decode()
+	}
+	return nil, errors.New("k2tree: no intact checkpoint in file")
+}
+
+// decode returns the tree of the current checkpoint, with its bits copied
+// into the backends of the options.
+func (s *treeStore) decode() (*K2Tree, error) {
+	image, ok := s.pf.readImage(s.live)
+	if !ok {
+		return nil, errors.New("k2tree: no intact checkpoint in file")
+	}
+	return decodeImage(image, s.options.Config)
+}
+
+// apply replays a logged change.
+func (k *K2Tree) apply(r walRecord) error {
+	switch r.op {
+	case walAdd:
+		_, err := k.TryAdd(r.i, r.j)
+		return err
+	case walRemove:
+		return k.Remove(r.i, r.j)
+	}
+	return fmt.Errorf("unknown log operation %d", r.op)
+}
+
+// writable returns ErrReadOnly if the tree can't be changed.
+func (k *K2Tree) writable() error {
+	if k.release != nil || (k.store != nil && k.store.readOnly) {
+		return ErrReadOnly
+	}
+	return nil
+}
+
+// logChange writes op on links to the log of a persistent tree, ahead of the
+// change itself.
+func (k *K2Tree) logChange(op walOp, links ...link) error {
+	if k.store == nil {
+		return nil
+	}
+	return k.store.wal.append(op, links...)
+}
+
+// logTxn writes a transaction of adds and removes to the log of a
+// persistent tree, ahead of the changes themselves.
+func (k *K2Tree) logTxn(adds, removes []link) error {
+	if k.store == nil {
+		return nil
+	}
+	return k.store.wal.appendTxn(adds, removes)
+}
+
+// changed checkpoints a persistent tree if its log is due for it. The change
+// is already made and logged by then, so a failed checkpoint isn't reported
+// as a failure of the change: the log keeps its records, and the checkpoint
+// is tried again after the next change, and by Checkpoint and Close.
+func (k *K2Tree) changed() {
+	if k.store == nil || k.store.options.CheckpointEvery <= 0 {
+		return
+	}
+	if k.store.wal.records < k.store.options.CheckpointEvery {
+		return
+	}
+	k.Checkpoint()
+}
+
+// Checkpoint writes the whole tree into its file and empties its log. If
+// the tree hasn't changed since the last checkpoint, it only syncs metadata
+// set since then.
+//
+// Every checkpoint is a full image of the tree, so it costs time and I/O in
+// proportion to the size of the tree, however few changes the log holds.
+// Trees with large, rarely changing checkpoints should set CheckpointEvery
+// high, or leave it at zero.
+//
+// The image is written to pages that no current checkpoint uses, and only
+// then is a root slot pointed at it, so a crash at any point leaves either
+// the old checkpoint or the new one intact.
+func (k *K2Tree) Checkpoint() error {
+	if k.store == nil {
+		return ErrNotPersistent
+	}
+	if k.store.readOnly {
+		return ErrReadOnly
+	}
+	s := k.store
+	if s.live.Seq != 0 && s.wal.records == 0 && !s.rebuilt {
+		return s.syncMetadata()
+	}
+	pf := s.pf
+	image := k.encodeImage()
+	need := (len(image) + pf.dataSize() - 1) / pf.dataSize()
+	// The new checkpoint takes the place of the one before the current one,
+	// so its pages can be reused.
+	if s.fallback.Seq != 0 {
+		err := pf.freePages(int(s.fallback.StartPage), int(s.fallback.NumPages))
+		if err != nil {
+			return err
+		}
+		s.fallback = rootSlot{}
+	}
+	start, err := pf.allocPages(need)
+	if err != nil {
+		return err
+	}
+	pf.writeImage(start, image)
+	err = pf.sync()
+	if err != nil {
+		return err
+	}
+	root := rootSlot{
+		Seq:       s.live.Seq + 1,
+		LSN:       s.wal.lastLSN(),
+		StartPage: int64(start),
+		NumPages:  int64(need),
+		ImageLen:  int64(len(image)),
+		ImageCRC:  crc32.Checksum(image, castagnoli),
+	}
+	pf.writeRoot(root)
+	pf.writeFreeList()
+	err = pf.sync()
+	if err != nil {
+		return err
+	}
+	s.fallback, s.live = s.live, root
+	s.rebuilt = false
+	s.unsynced = false
+	return s.wal.reset()
+}
+
+// syncMetadata syncs the file if metadata has been written to it since it
+// was last synced.
+func (s *treeStore) syncMetadata() error {
+	if !s.unsynced {
+		return nil
+	}
+	err := s.pf.sync()
+	if err != nil {
+		return err
+	}
+	s.unsynced = false
+	return nil
+}
+
+// Vacuum gives the unused space in the file of a persistent tree back to the
+// file system. It drops the checkpoint before the current one, moves the
+// pages of the current one to the front of the file, and cuts the file off
+// after them; pages lost to crashes are reclaimed along the way. For the
+// file to be as small as it can be, Compact and Checkpoint the tree first.
+//
+// Pages are moved by copying them and pointing a root slot at the copy, as
+// Checkpoint does, so a crash leaves one copy or the other intact.
+func (k *K2Tree) Vacuum() error {
+	if k.store == nil {
+		return ErrNotPersistent
+	}
+	if k.store.readOnly {
+		return ErrReadOnly
+	}
+	s := k.store
+	pf := s.pf
+	pf.clearRoot(s.live.Seq + 1)
+	s.fallback = rootSlot{}
+	pf.free = []extent{{0, pf.pages}}
+	if s.live.Seq != 0 {
+		pf.free = subtract(pf.free, extent{int(s.live.StartPage), int(s.live.NumPages)})
+	}
+	err := pf.trimFree()
+	if err != nil {
+		return err
+	}
+	// If the current checkpoint doesn't fit before where it is now, the
+	// first move takes it to the end of the file, and the second to the
+	// front.
+	for s.live.Seq != 0 && s.live.StartPage != 0 {
+		err = s.relocate()
+		if err != nil {
+			return err
+		}
+	}
+	pf.writeFreeList()
+	return pf.sync()
+}
+
+// relocate moves the pages of the current checkpoint to the lowest free
+// pages that can hold them.
+func (s *treeStore) relocate() error {
+	pf := s.pf
+	old := s.live
+	start, err := pf.allocPages(int(old.NumPages))
+	if err != nil {
+		return err
+	}
+	for p := 0; p < int(old.NumPages); p++ {
+		copy(pf.page(start+p), pf.page(int(old.StartPage)+p))
+	}
+	err = pf.sync()
+	if err != nil {
+		return err
+	}
+	root := old
+	root.Seq++
+	root.StartPage = int64(start)
+	pf.writeRoot(root)
+	err = pf.sync()
+	if err != nil {
+		return err
+	}
+	s.live = root
+	pf.clearRoot(root.Seq + 1)
+	return pf.freePages(int(old.StartPage), int(old.NumPages))
+}
+
+// Sync fsyncs the log of a persistent tree, for trees opened with a Sync
+// policy that doesn't.
+func (k *K2Tree) Sync() error {
+	if k.store == nil {
+		return ErrNotPersistent
+	}
+	if k.store.readOnly {
+		return ErrReadOnly
+	}
+	return k.store.wal.sync()
+}
+
+// Close checkpoints a persistent tree and closes its files, or releases a
+// snapshot, and ends the subscriptions to the tree. The tree can't be used
+// afterwards. Close does nothing else for other trees that live only in
+// memory.
+func (k *K2Tree) Close() error {
+	k.endSubscriptions()
+	if k.release != nil {
+		k.release()
+		k.release = nil
+		k.tbits, k.lbits = nil, nil
+		return nil
+	}
+	if k.store == nil {
+		return nil
+	}
+	if !k.store.readOnly {
+		err := k.Checkpoint()
+		if err != nil {
+			return err
+		}
+	}
+	s := k.store
+	k.store = nil
+	err := s.wal.close()
+	if err != nil {
+		s.pf.Close()
+		return err
+	}
+	return s.pf.Close()
+}
+
+/*
+Image Layout:
+
+A checkpoint is a serialized tree, in big-endian:
+
+	TreeK (8B)
+	CellK (8B)
+	Rectangular (8B)
+	Levels (8B)
+	TreeBits (8B)
+	LeafBits (8B)
+	LevelOffsets ((Levels+1) x 8B)
+	Shapes ((Levels+1) x 4 x 8B, as rowBits, colBits, rowShift, colShift)
+	Tree bits (packed, first bit in the high bit of the first byte)
+	Leaf bits (packed)
+*/
+
+const imageHeaderSize = 6 * 8
+
+// encodeImage serializes the tree.
+func (k *K2Tree) encodeImage() []byte {
+	tlen, llen := k.tbits.Len(), k.lbits.Len()
+	var levels int
+	if k.tbits.Len() != 0 {
+		levels = k.levels
+	}
+	size := imageHeaderSize + (levels+1)*8*5 + (tlen+7)/8 + (llen+7)/8
+	out := make([]byte, 0, size)
+	var rect int
+	if k.rectangular {
+		rect = 1
+	}
+	for _, v := range []int{k.tk.kPerLayer, k.lk.kPerLayer, rect, levels, tlen, llen} {
+		out = appendInt(out, v)
+	}
+	for l := 0; l <= levels; l++ {
+		var off int
+		if levels != 0 {
+			off = k.levelOffsets[l]
+		}
+		out = appendInt(out, off)
+	}
+	for l := 0; l <= levels; l++ {
+		var s levelShape
+		if levels != 0 {
+			s = k.shapes[l]
+		}
+		out = appendInt(out, int(s.rowBits))
+		out = appendInt(out, int(s.colBits))
+		out = appendInt(out, int(s.rowShift))
+		out = appendInt(out, int(s.colShift))
+	}
+	out = appendBits(out, k.tbits)
+	return appendBits(out, k.lbits)
+}
+
+func appendInt(b []byte, v int) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(int64(v)))
+	return append(b, buf[:]...)
+}
+
+// appendBits appends the packed bits of a.
+func appendBits(b []byte, a bitarray) []byte {
+	n := a.Len()
+	for x := 0; x < n; x += 8 {
+		var c byte
+		for bit := 0; bit < 8 && x+bit < n; bit++ {
+			if a.Get(x + bit) {
+				c |= 0x80 >> uint(bit)
+			}
+		}
+		b = append(b, c)
+	}
+	return b
+}
+
+// layerDefForK returns the layer definition that splits a block k ways on
+// each axis.
+func layerDefForK(k int) (LayerDef, error) {
+	switch k {
+	case FourBitsPerLayer.kPerLayer:
+		return FourBitsPerLayer, nil
+	case SixteenBitsPerLayer.kPerLayer:
+		return SixteenBitsPerLayer, nil
+	}
+	return LayerDef{}, fmt.Errorf("unsupported layer size k=%d", k)
+}
+
+// imageReader reads the fields of an image, remembering the first error.
+type imageReader struct {
+	b   []byte
+	err error
+}
+
+func (r *imageReader) int() int {
+	if len(r.b) < 8 {
+		r.err = errors.New("k2tree: image is truncated")
+		return 0
+	}
+	v := int(int64(binary.BigEndian.Uint64(r.b)))
+	r.b = r.b[8:]
+	return v
+}
+
+// packed returns the next n packed bits.
+func (r *imageReader) packed(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	nbytes := (n + 7) / 8
+	if n < 0 || len(r.b) < nbytes {
+		r.err = errors.New("k2tree: image is truncated")
+		return nil
+	}
+	if n%4 != 0 {
+		r.err = fmt.Errorf("k2tree: bit count %d is not a multiple of 4", n)
+		return nil
+	}
+	b := r.b[:nbytes]
+	r.b = r.b[nbytes:]
+	return b
+}
+
+// fillBits appends the first n of the packed bits b to a.
+func fillBits(a bitarray, b []byte, n int) error {
+	err := a.Insert(n, a.Len())
+	if err != nil {
+		return err
+	}
+	for x := 0; x < n; x++ {
+		if b[x/8]&(0x80>>uint(x%8)) != 0 {
+			a.Set(x, true)
+		}
+	}
+	return nil
+}
+
+// image is the parsed form of a serialized tree.
+type image struct {
+	tk, lk  int
+	rect    bool
+	levels  int
+	tlen    int
+	llen    int
+	offsets []int
+	shapes  []levelShape
+	tbits   []byte
+	lbits   []byte
+}
+
+// parseImage splits a serialized tree into its fields, without checking
+// that they describe a valid tree.
+func parseImage(b []byte) (*image, error) {
+	r := &imageReader{b: b}
+	im, err := r.header()
+	if err != nil {
+		return nil, err
+	}
+	im.tbits = r.packed(im.tlen)
+	im.lbits = r.packed(im.llen)
+	if r.err != nil {
+		return nil, r.err
+	}
+	return im, nil
+}
+
+// header reads the fields of an image that come before its bits.
+func (r *imageReader) header() (*image, error) {
+	im := &image{}
+	im.tk, im.lk = r.int(), r.int()
+	im.rect = r.int() != 0
+	im.levels, im.tlen, im.llen = r.int(), r.int(), r.int()
+	if r.err != nil {
+		return nil, r.err
+	}
+	if im.levels < 0 || im.levels > 64 {
+		return nil, fmt.Errorf("k2tree: image has %d levels", im.levels)
+	}
+	im.offsets = make([]int, im.levels+1)
+	for l := range im.offsets {
+		im.offsets[l] = r.int()
+	}
+	im.shapes = make([]levelShape, im.levels+1)
+	for l := range im.shapes {
+		im.shapes[l].rowBits = uint(r.int())
+		im.shapes[l].colBits = uint(r.int())
+		im.shapes[l].rowShift = uint(r.int())
+		im.shapes[l].colShift = uint(r.int())
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return im, nil
+}
+
+// decodeImage deserializes a tree, storing its bits in the backends of
+// config.
+func decodeImage(b []byte, config Config) (*K2Tree, error) {
+	im, err := parseImage(b)
+	if err != nil {
+		return nil, err
+	}
+	k, err := im.tree(config)
+	if err != nil {
+		return nil, err
+	}
+	err = fillBits(k.tbits, im.tbits, im.tlen)
+	if err != nil {
+		return nil, err
+	}
+	err = fillBits(k.lbits, im.lbits, im.llen)
+	if err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// mapImage returns the tree of the image in data, the data of the pages
+// that hold it, each size bytes but the last, reading its bits in place.
+func mapImage(data [][]byte, size int, config Config) (*K2Tree, error) {
+	// The header is at most a few KiB, so it fits in the first page.
+	r := &imageReader{b: data[0]}
+	im, err := r.header()
+	if err != nil {
+		return nil, err
+	}
+	var imageLen int
+	for _, d := range data {
+		imageLen += len(d)
+	}
+	tstart := len(data[0]) - len(r.b)
+	lstart := tstart + (im.tlen+7)/8
+	if im.tlen < 0 || im.llen < 0 || lstart+(im.llen+7)/8 > imageLen {
+		return nil, errors.New("k2tree: image is truncated")
+	}
+	if im.tlen%4 != 0 || im.llen%4 != 0 {
+		return nil, fmt.Errorf("k2tree: bit counts %d and %d are not multiples of 4", im.tlen, im.llen)
+	}
+	k, err := im.tree(config)
+	if err != nil {
+		return nil, err
+	}
+	k.tbits = newMappedArray(data, size, tstart, im.tlen)
+	k.lbits = newMappedArray(data, size, lstart, im.llen)
+	return k, nil
+}
+
+// tree returns a tree of the shape of im, with empty bitarrays from the
+// backends of config.
+func (im *image) tree(config Config) (*K2Tree, error) {
+	var err error
+	config.TreeLayerDef, err = layerDefForK(im.tk)
+	if err != nil {
+		return nil, err
+	}
+	config.CellLayerDef, err = layerDefForK(im.lk)
+	if err != nil {
+		return nil, err
+	}
+	k, err := NewWithConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	k.rectangular = im.rect
+	if im.levels != 0 {
+		k.levels = im.levels
+		k.levelOffsets = im.offsets
+		k.shapes = im.shapes
+	}
+	return k, nil
+}
@@ -0,0 +1,604 @@
+package k2tree
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func tempTreePath(t *testing.T) (path string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "k2tree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "tree.k2"), func() { os.RemoveAll(dir) }
+}
+
+// crash drops a persistent tree's files without checkpointing, as if the
+// process had been killed.
+func crash(t *testing.T, k *K2Tree) {
+	err := k.store.wal.close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = k.store.pf.unmap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = k.store.pf.file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.store = nil
+}
+
+var testOpenOptions = OpenOptions{
+	Config:   FourFourConfig,
+	PageSize: 2 * blockSize,
+	Sync:     SyncNever,
+}
+
+func addRandom(t *testing.T, k *K2Tree, expected map[link]bool, n, maxID int) {
+	for x := 0; x < n; x++ {
+		l := link{rand.Intn(maxID), rand.Intn(maxID)}
+		err := k.Add(l.i, l.j)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected[l] = true
+	}
+}
+
+func checkLinks(t *testing.T, k *K2Tree, expected map[link]bool) {
+	t.Helper()
+	links := k.links()
+	if len(links) != len(expected) {
+		t.Fatalf("expected %d links, got %d", len(expected), len(links))
+	}
+	for _, l := range links {
+		if !expected[l] {
+			t.Fatalf("unexpected link %v", l)
+		}
+	}
+}
+
+func TestOpenCloseReopen(t *testing.T) {
+	path, cleanup := tempTreePath(t)
+	defer cleanup()
+	k, err := Open(path, testOpenOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := make(map[link]bool)
+	addRandom(t, k, expected, 2000, 5000)
+	err = k.Checkpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addRandom(t, k, expected, 2000, 20000)
+	for l := range expected {
+		if rand.Intn(4) == 0 {
+			k.Remove(l.i, l.j)
+			delete(expected, l)
+		}
+	}
+	err = k.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k, err = Open(path, testOpenOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer k.Close()
+	checkLinks(t, k, expected)
+	if k.tk != FourBitsPerLayer || k.lk != FourBitsPerLayer {
+		t.Error("layer definitions not restored")
+	}
+	fi, err := os.Stat(path + ".wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 0 {
+		t.Errorf("log holds %d bytes after Close", fi.Size())
+	}
+}
+
+func TestReplayAfterCrash(t *testing.T) {
+	path, cleanup := tempTreePath(t)
+	defer cleanup()
+	k, err := Open(path, testOpenOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := make(map[link]bool)
+	addRandom(t, k, expected, 500, 1000)
+	err = k.Checkpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addRandom(t, k, expected, 500, 3000)
+	for l := range expected {
+		k.Remove(l.i, l.j)
+		delete(expected, l)
+		break
+	}
+	crash(t, k)
+
+	// Tear the last record in half.
+	f, err := os.OpenFile(path+".wal", os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(make([]byte, walRecordSize/2))
+	f.Close()
+
+	k, err = Open(path, testOpenOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkLinks(t, k, expected)
+	// Writes after a replay follow on from the intact records.
+	addRandom(t, k, expected, 10, 1000)
+	crash(t, k)
+	k, err = Open(path, testOpenOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer k.Close()
+	checkLinks(t, k, expected)
+}
+
+func TestCheckpointFallsBack(t *testing.T) {
+	path, cleanup := tempTreePath(t)
+	defer cleanup()
+	k, err := Open(path, testOpenOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := make(map[link]bool)
+	addRandom(t, k, first, 300, 1000)
+	err = k.Checkpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addRandom(t, k, make(map[link]bool), 300, 1000)
+	err = k.Checkpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Tear the newest root slot.
+	k.store.pf.bytes[rootSlotOffsets[k.store.live.Seq%2]+3] ^= 0xFF
+	crash(t, k)
+
+	k, err = Open(path, testOpenOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer k.Close()
+	checkLinks(t, k, first)
+}
+
+func TestCheckpointEvery(t *testing.T) {
+	path, cleanup := tempTreePath(t)
+	defer cleanup()
+	options := testOpenOptions
+	options.CheckpointEvery = 100
+	options.Sync = SyncAlways
+	options.Rectangular = true
+	k, err := Open(path, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := make(map[link]bool)
+	addRandom(t, k, expected, 250, 100000)
+	if k.store.live.Seq != 2 {
+		t.Errorf("expected 2 checkpoints, got %d", k.store.live.Seq)
+	}
+	if k.store.wal.records != 50 {
+		t.Errorf("expected 50 records in the log, got %d", k.store.wal.records)
+	}
+	crash(t, k)
+	k, err = Open(path, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer k.Close()
+	checkLinks(t, k, expected)
+	if !k.rectangular {
+		t.Error("tree is no longer rectangular")
+	}
+}
+
+func TestFailedCheckpointEveryIsDeferred(t *testing.T) {
+	path, cleanup := tempTreePath(t)
+	defer cleanup()
+	options := testOpenOptions
+	options.CheckpointEvery = 10
+	k, err := Open(path, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The file can't grow to hold a checkpoint through a read-only handle.
+	file := k.store.pf.file
+	k.store.pf.file, err = os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := make(map[link]bool)
+	addRandom(t, k, expected, 20, 100)
+	if k.store.live.Seq != 0 || k.store.wal.records != 20 {
+		t.Fatalf("expected no checkpoints and 20 records, got %d and %d", k.store.live.Seq, k.store.wal.records)
+	}
+	if err := k.Checkpoint(); err == nil {
+		t.Fatal("expected an error from Checkpoint")
+	}
+	k.store.pf.file.Close()
+	k.store.pf.file = file
+	err = k.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k, err = Open(path, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer k.Close()
+	checkLinks(t, k, expected)
+	if k.store.live.Seq != 1 {
+		t.Errorf("expected Close to checkpoint, got %d checkpoints", k.store.live.Seq)
+	}
+}
+
+func TestOpenReadOnly(t *testing.T) {
+	path, cleanup := tempTreePath(t)
+	defer cleanup()
+	_, err := OpenReadOnly(path, testOpenOptions)
+	if err == nil {
+		t.Fatal("expected an error opening a missing tree read-only")
+	}
+	w, err := Open(path, testOpenOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := make(map[link]bool)
+	addRandom(t, w, expected, 500, 2000)
+	err = w.Checkpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addRandom(t, w, expected, 100, 2000)
+	crash(t, w)
+	walSize := func() int64 {
+		fi, err := os.Stat(path + ".wal")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fi.Size()
+	}
+	logged := walSize()
+
+	// The reader sees the checkpoint and the changes logged after it, which
+	// are replayed onto a copy of the checkpoint.
+	r, err := OpenReadOnly(path, testOpenOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkLinks(t, r, expected)
+	if _, ok := r.lbits.(*mappedArray); ok {
+		t.Error("changes were replayed onto the mapped checkpoint")
+	}
+	var l link
+	for l = range expected {
+		break
+	}
+	for _, err := range []error{
+		r.Add(1, 1),
+		r.Remove(l.i, l.j),
+		r.Compact(),
+		r.Checkpoint(),
+		r.Sync(),
+	} {
+		if err != ErrReadOnly {
+			t.Errorf("expected ErrReadOnly, got %v", err)
+		}
+	}
+	_, err = r.AddBatch([]Edge{{1, 1}})
+	if err != ErrReadOnly {
+		t.Errorf("expected ErrReadOnly, got %v", err)
+	}
+	checkLinks(t, r, expected)
+	err = r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if walSize() != logged {
+		t.Error("read-only open changed the log")
+	}
+}
+
+func TestOpenReadOnlyMapped(t *testing.T) {
+	path, cleanup := tempTreePath(t)
+	defer cleanup()
+	expected := checkpointed(t, path)
+
+	// With nothing in the log to replay, readers use the mapped checkpoint.
+	var readers []*K2Tree
+	for x := 0; x < 2; x++ {
+		r, err := OpenReadOnly(path, testOpenOptions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		if _, ok := r.lbits.(*mappedArray); !ok {
+			t.Fatalf("expected a mapped tree, got %s", r.lbits.debug())
+		}
+		checkLinks(t, r, expected)
+		readers = append(readers, r)
+	}
+	for l := range expected {
+		for _, r := range readers {
+			if !r.Contains(l.i, l.j) {
+				t.Fatalf("reader is missing link %v", l)
+			}
+		}
+	}
+	err := readers[0].Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkLinks(t, readers[1], expected)
+}
+
+func TestOpenLocks(t *testing.T) {
+	path, cleanup := tempTreePath(t)
+	defer cleanup()
+	w, err := Open(path, testOpenOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	probe, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lockFile(probe, false, false)
+	probe.Close()
+	if err == nil {
+		w.Close()
+		t.Skip("files aren't locked on this platform")
+	}
+	_, err = Open(path, testOpenOptions)
+	if err != ErrLocked {
+		t.Fatalf("expected ErrLocked opening a second writer, got %v", err)
+	}
+	_, err = OpenReadOnly(path, testOpenOptions)
+	if err != ErrLocked {
+		t.Fatalf("expected ErrLocked opening a reader, got %v", err)
+	}
+
+	// A waiting reader gets the tree once the writer closes it.
+	opened := make(chan error)
+	var r *K2Tree
+	go func() {
+		options := testOpenOptions
+		options.WaitForLock = true
+		var err error
+		r, err = OpenReadOnly(path, options)
+		opened <- err
+	}()
+	err = w.Add(1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = <-opened
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if !r.Contains(1, 2) {
+		t.Error("reader doesn't see the writer's link")
+	}
+
+	// Readers share the file, but keep writers out.
+	r2, err := OpenReadOnly(path, testOpenOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r2.Close()
+	_, err = Open(path, testOpenOptions)
+	if err != ErrLocked {
+		t.Fatalf("expected ErrLocked opening a writer, got %v", err)
+	}
+}
+
+// failingInsert is a bitarray whose Inserts fail.
+type failingInsert struct {
+	bitarray
+}
+
+func (f failingInsert) Insert(n, at int) error {
+	return errFull
+}
+
+func TestFailedAddsAreNotLogged(t *testing.T) {
+	path, cleanup := tempTreePath(t)
+	defer cleanup()
+	k, err := Open(path, testOpenOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := make(map[link]bool)
+	addRandom(t, k, expected, 100, 100)
+	records := k.store.wal.records
+	tbits := k.tbits
+	k.tbits = failingInsert{tbits}
+	if _, err := k.TryAdd(5000, 5000); err != errFull {
+		t.Fatalf("expected %v from TryAdd, got %v", errFull, err)
+	}
+	// The batch fits the tree, so it fails inserting blocks rather than
+	// growing.
+	lbits := k.lbits
+	k.lbits = failingInsert{lbits}
+	far := link{k.rowExtent() - 1, k.colExtent() - 1}
+	if _, err := k.AddBatch([]Edge{{1, 2}, {far.i, far.j}}); err != errFull {
+		t.Fatalf("expected %v from AddBatch, got %v", errFull, err)
+	}
+	if k.store.wal.records != records {
+		t.Fatalf("failed adds wrote %d records to the log", k.store.wal.records-records)
+	}
+	k.tbits, k.lbits = tbits, lbits
+	crash(t, k)
+
+	k, err = Open(path, testOpenOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer k.Close()
+	checkLinks(t, k, expected)
+}
+
+func TestFailedAppendIsCutOff(t *testing.T) {
+	path, cleanup := tempTreePath(t)
+	defer cleanup()
+	k, err := Open(path, testOpenOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := make(map[link]bool)
+	addRandom(t, k, expected, 100, 100)
+	lsn := k.store.wal.lastLSN()
+
+	// Leave half a record at the end of the log, as a torn write would, and
+	// make the next write fail along with cutting it off.
+	w := k.store.wal
+	file := w.file
+	_, err = file.Write(make([]byte, walRecordSize/2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.file, err = os.Open(path + ".wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := k.Add(5000, 5000); err == nil {
+		t.Fatal("expected an error adding with a read-only log")
+	}
+	if w.lastLSN() != lsn {
+		t.Errorf("a failed add used LSNs %d to %d", lsn+1, w.lastLSN())
+	}
+	w.file.Close()
+	w.file = file
+
+	err = k.Add(200, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected[link{200, 200}] = true
+	crash(t, k)
+
+	k, err = Open(path, testOpenOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer k.Close()
+	checkLinks(t, k, expected)
+	if k.store.wal.lastLSN() != lsn+1 {
+		t.Errorf("expected the log to end at LSN %d, got %d", lsn+1, k.store.wal.lastLSN())
+	}
+}
+
+func TestTornBatchIsLostWhole(t *testing.T) {
+	path, cleanup := tempTreePath(t)
+	defer cleanup()
+	k, err := Open(path, testOpenOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := make(map[link]bool)
+	addRandom(t, k, expected, 100, 100)
+	var batch []Edge
+	for x := 0; x < 50; x++ {
+		batch = append(batch, Edge{rand.Intn(1000), 100 + x})
+	}
+	_, err = k.AddBatch(batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crash(t, k)
+
+	// Cut the last record of the batch in half.
+	fi, err := os.Stat(path + ".wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Truncate(path+".wal", fi.Size()-walRecordSize/2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err = Open(path, testOpenOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer k.Close()
+	checkLinks(t, k, expected)
+}
+
+func TestCheckpointSkipsUnchanged(t *testing.T) {
+	path, cleanup := tempTreePath(t)
+	defer cleanup()
+	k, err := Open(path, testOpenOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer k.Close()
+	expected := make(map[link]bool)
+	addRandom(t, k, expected, 500, 2000)
+	err = k.Checkpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq := k.store.live.Seq
+	err = k.Checkpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.store.live.Seq != seq {
+		t.Error("checkpointed a tree with an empty log")
+	}
+	for l := range expected {
+		k.Remove(l.i, l.j)
+		delete(expected, l)
+		break
+	}
+	err = k.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = k.Checkpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.store.live.Seq != seq+1 {
+		t.Error("didn't checkpoint a changed tree")
+	}
+	err = k.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = k.Checkpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.store.live.Seq != seq+2 {
+		t.Error("didn't checkpoint a compacted tree")
+	}
+	checkLinks(t, k, expected)
+}
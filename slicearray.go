@@ -3,8 +3,6 @@ package k2tree
 import (
 	"fmt"
 	"math/bits"
-
-	popcount "github.com/tmthrgd/go-popcount"
 )
 
 type sliceArray struct {
@@ -72,7 +70,7 @@ func (s *sliceArray) Count(from, to int) int {
 	if endbit != 0 {
 		c += bits.OnesCount8(s.bytes[endoff] & (0xFF &^ (0xFF >> endbit)))
 	}
-	c += int(popcount.CountBytes(s.bytes[startoff:endoff]))
+	c += int(countBytes(s.bytes[startoff:endoff]))
 	return c
 }
 
@@ -0,0 +1,263 @@
+package k2tree
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// snapshotter is implemented by bitarrays that can share their storage with
+// a copy of themselves, copying it a page at a time as it's written to.
+type snapshotter interface {
+	// snapshot returns a copy of the bitarray, and a func that releases the
+	// pages it shares. Either of the two may be written to afterwards, and
+	// only copies the pages they still share. It returns a nil bitarray if
+	// the storage can't be shared.
+	snapshot() (bitarray, func())
+}
+
+// Snapshot returns a read-only view of the tree as it is now, which the
+// changes made to the tree afterwards don't affect. Every method that would
+// change the view returns ErrReadOnly.
+//
+// The view shares the pages of the tree's bitarrays with it, and the tree
+// copies a page the first time it writes to it while the view is open, so
+// taking a snapshot costs a pointer copy per page. Bitarrays that can't
+// share their storage (anything but PagedSliceBackend and PagedBitBackend,
+// under any index) are copied whole. The view may be read from one other
+// goroutine while the tree is written, but Snapshot itself mustn't race
+// with writes. Close the view to release its pages.
+func (k *K2Tree) Snapshot() (*K2Tree, error) {
+	tbits, trelease, err := snapshotBits(k.tbits, k.newTree)
+	if err != nil {
+		return nil, err
+	}
+	lbits, lrelease, err := snapshotBits(k.lbits, k.newLeaf)
+	if err != nil {
+		trelease()
+		return nil, err
+	}
+	c := *k
+	c.tbits, c.lbits = tbits, lbits
+	c.levelOffsets = append([]int(nil), k.levelOffsets...)
+	c.shapes = append([]levelShape(nil), k.shapes...)
+	c.store = nil
+	c.observers = nil
+	c.release = func() {
+		trelease()
+		lrelease()
+	}
+	return &c, nil
+}
+
+// snapshotBits returns a copy of a, sharing its storage if it can,
+// or else copying it into a new bitarray from newf, and a func that releases
+// it.
+func snapshotBits(a bitarray, newf newBitArrayFunc) (bitarray, func(), error) {
+	if s, ok := a.(snapshotter); ok {
+		if c, release := s.snapshot(); c != nil {
+			return c, release, nil
+		}
+	}
+	c := newf()
+	err := c.Insert(a.Len(), 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	for at := 0; at < a.Len(); at++ {
+		if a.Get(at) {
+			c.Set(at, true)
+		}
+	}
+	return c, func() {}, nil
+}
+
+// pageRefs counts the open snapshots that share each page of a paged
+// bitarray. Pages are keyed by a pointer that identifies their storage.
+type pageRefs struct {
+	// open is the number of open snapshots, read without the lock so that
+	// writes to an array that has none stay cheap.
+	open int32
+	mu   sync.Mutex
+	refs map[interface{}]int
+}
+
+func newPageRefs() *pageRefs {
+	return &pageRefs{refs: make(map[interface{}]int)}
+}
+
+// shared returns whether any open snapshot holds page.
+func (r *pageRefs) shared(page interface{}) bool {
+	if atomic.LoadInt32(&r.open) == 0 {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.refs[page] != 0
+}
+
+// hold records a snapshot of pages, and returns the func that releases it.
+func (r *pageRefs) hold(pages []interface{}) func() {
+	r.mu.Lock()
+	for _, p := range pages {
+		r.refs[p]++
+	}
+	r.mu.Unlock()
+	atomic.AddInt32(&r.open, 1)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			r.mu.Lock()
+			for _, p := range pages {
+				r.refs[p]--
+				if r.refs[p] == 0 {
+					delete(r.refs, p)
+				}
+			}
+			r.mu.Unlock()
+			atomic.AddInt32(&r.open, -1)
+		})
+	}
+}
+
+// snapshot implements snapshotter. The levels of the copy are the same pages
+// as the levels of p, which each of them copies before it next writes to
+// them.
+func (p *pagedBitarray) snapshot() (bitarray, func()) {
+	if p.refs == nil {
+		p.refs = newPageRefs()
+	}
+	s := *p
+	s.pages = append([][]byte(nil), p.pages...)
+	s.levelLength = append([]int(nil), p.levelLength...)
+	s.levelTree = append([]int(nil), p.levelTree...)
+	keys := make([]interface{}, len(p.pages))
+	p.shared = make([]bool, len(p.pages))
+	for l, page := range p.pages {
+		keys[l] = &page[0]
+		p.shared[l] = true
+	}
+	s.shared = append([]bool(nil), p.shared...)
+	return &s, p.refs.hold(keys)
+}
+
+// own makes level l safe to write to, copying its page if a snapshot holds
+// it.
+func (p *pagedBitarray) own(l int) {
+	if p.shared == nil || !p.shared[l] {
+		return
+	}
+	p.shared[l] = false
+	if !p.refs.shared(&p.pages[l][0]) {
+		return
+	}
+	page := make([]byte, p.pagesize)
+	copy(page, p.pages[l])
+	p.pages[l] = page
+}
+
+// snapshot implements snapshotter. The copy holds the same sliceArrays as
+// p, which each of them copies before it next writes to them.
+func (p *pagedSliceArray) snapshot() (bitarray, func()) {
+	if p.refs == nil {
+		p.refs = newPageRefs()
+	}
+	keys := make([]interface{}, len(p.arrays))
+	p.shared = make([]bool, len(p.arrays))
+	for i, a := range p.arrays {
+		keys[i] = a
+		p.shared[i] = true
+	}
+	s := &pagedSliceArray{
+		arrays:   append([]*sliceArray(nil), p.arrays...),
+		pagesize: p.pagesize,
+		refs:     p.refs,
+		shared:   append([]bool(nil), p.shared...),
+	}
+	return s, p.refs.hold(keys)
+}
+
+// own makes array i safe to write to, copying it if a snapshot holds it.
+func (p *pagedSliceArray) own(i int) {
+	if p.shared == nil || !p.shared[i] {
+		return
+	}
+	p.shared[i] = false
+	a := p.arrays[i]
+	if !p.refs.shared(a) {
+		return
+	}
+	p.arrays[i] = &sliceArray{
+		bytes:  append([]byte(nil), a.bytes...),
+		length: a.length,
+		total:  a.total,
+	}
+}
+
+// snapshot implements snapshotter if the bits beneath the index do. The
+// copy has its own cache.
+func (b *binaryLRUIndex) snapshot() (bitarray, func()) {
+	s, ok := b.bits.(snapshotter)
+	if !ok {
+		return nil, nil
+	}
+	bits, release := s.snapshot()
+	if bits == nil {
+		return nil, nil
+	}
+	c := *b
+	c.bits = bits
+	c.offsets = append([]int(nil), b.offsets...)
+	c.counts = append([]int(nil), b.counts...)
+	c.historyMap = append([]int(nil), b.historyMap...)
+	return &c, release
+}
+
+// snapshot implements snapshotter if the bits beneath the index do.
+func (q *int16index) snapshot() (bitarray, func()) {
+	s, ok := q.bits.(snapshotter)
+	if !ok {
+		return nil, nil
+	}
+	bits, release := s.snapshot()
+	if bits == nil {
+		return nil, nil
+	}
+	return &int16index{
+		bits:   bits,
+		counts: append([]uint16(nil), q.counts...),
+	}, release
+}
+
+// snapshot implements snapshotter if the bits beneath the index do.
+func (q *quartileIndex) snapshot() (bitarray, func()) {
+	s, ok := q.bits.(snapshotter)
+	if !ok {
+		return nil, nil
+	}
+	bits, release := s.snapshot()
+	if bits == nil {
+		return nil, nil
+	}
+	c := *q
+	c.bits = bits
+	return &c, release
+}
+
+// snapshot implements snapshotter if the bits beneath the index do.
+func (f *fenwickIndex) snapshot() (bitarray, func()) {
+	s, ok := f.bits.(snapshotter)
+	if !ok {
+		return nil, nil
+	}
+	bits, release := s.snapshot()
+	if bits == nil {
+		return nil, nil
+	}
+	c := *f
+	c.bits = bits
+	c.lens = append([]int(nil), f.lens...)
+	c.counts = append([]int(nil), f.counts...)
+	c.lenTree = append([]int(nil), f.lenTree...)
+	c.countTree = append([]int(nil), f.countTree...)
+	return &c, release
+}
@@ -0,0 +1,150 @@
+package k2tree
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// linkSet returns the links of k as a set.
+func linkSet(k *K2Tree) map[link]bool {
+	out := make(map[link]bool)
+	for _, l := range k.links() {
+		out[l] = true
+	}
+	return out
+}
+
+func TestSnapshot(t *testing.T) {
+	small := Backend{Kind: PagedBitBackend, PageSize: 64, HighWater: 0.8, LowWater: WaterMark(0.5)}
+	configs := map[string]Config{
+		"Default":  DefaultConfig,
+		"FourFour": FourFourConfig,
+		"SmallPages": {
+			TreeLayerDef: FourBitsPerLayer,
+			CellLayerDef: FourBitsPerLayer,
+			TreeBackend:  Backend{Kind: PagedSliceBackend, PageSize: 256, Index: FenwickIndex},
+			CellBackend:  small,
+		},
+		"Copied": {
+			TreeLayerDef: SixteenBitsPerLayer,
+			CellLayerDef: FourBitsPerLayer,
+			TreeBackend:  Backend{Kind: SliceBackend, Index: QuartileIndex},
+			CellBackend:  Backend{Kind: ByteSliceBackend},
+		},
+	}
+	for name, config := range configs {
+		t.Run(name, func(t *testing.T) {
+			k, err := NewWithConfig(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := make(map[link]bool)
+			addRandom(t, k, expected, 2000, 500)
+			s, err := k.Snapshot()
+			if err != nil {
+				t.Fatal(err)
+			}
+			before := make(map[link]bool)
+			for l := range expected {
+				before[l] = true
+			}
+			// The tree grows, and loses links, under the snapshot.
+			addRandom(t, k, expected, 2000, 5000)
+			for l := range expected {
+				if rand.Intn(3) == 0 {
+					k.Remove(l.i, l.j)
+					delete(expected, l)
+				}
+			}
+			s2, err := k.Snapshot()
+			if err != nil {
+				t.Fatal(err)
+			}
+			middle := make(map[link]bool)
+			for l := range expected {
+				middle[l] = true
+			}
+			addRandom(t, k, expected, 1000, 5000)
+
+			checkLinks(t, k, expected)
+			checkLinks(t, s, before)
+			checkLinks(t, s2, middle)
+			if err := s.Add(1, 1); err != ErrReadOnly {
+				t.Errorf("expected ErrReadOnly, got %v", err)
+			}
+			for _, v := range []*K2Tree{s, s2} {
+				err = v.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			addRandom(t, k, expected, 100, 5000)
+			checkLinks(t, k, expected)
+		})
+	}
+}
+
+func TestSnapshotSharesPages(t *testing.T) {
+	p := newPagedBitarray(64, 0.8, 0.5)
+	err := p.Insert(64*8*4, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Set(3, true)
+	c, release := p.snapshot()
+	s := c.(*pagedBitarray)
+	for l := range p.pages {
+		if &p.pages[l][0] != &s.pages[l][0] {
+			t.Fatalf("level %d isn't shared", l)
+		}
+	}
+	p.Set(5, true)
+	if &p.pages[0][0] == &s.pages[0][0] || s.Get(5) || !s.Get(3) {
+		t.Error("writing to a shared level didn't copy it")
+	}
+	if &p.pages[1][0] != &s.pages[1][0] {
+		t.Error("an unwritten level was copied")
+	}
+	release()
+	release()
+	if len(p.refs.refs) != 0 || p.refs.open != 0 {
+		t.Fatalf("pages still held after release: %v", p.refs.refs)
+	}
+	page := &p.pages[1][0]
+	p.Set(64*8+1, true)
+	if &p.pages[1][0] != page {
+		t.Error("a released level was copied")
+	}
+}
+
+func TestSnapshotConcurrentReads(t *testing.T) {
+	k, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := make(map[link]bool)
+	addRandom(t, k, expected, 5000, 2000)
+	s, err := k.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	done := make(chan map[link]bool)
+	go func() {
+		seen := make(map[link]bool)
+		for x := 0; x < 5; x++ {
+			seen = linkSet(s)
+		}
+		done <- seen
+	}()
+	addRandom(t, k, make(map[link]bool), 5000, 4000)
+	seen := <-done
+	if len(seen) != len(expected) {
+		t.Fatalf("expected %d links in the snapshot, got %d", len(expected), len(seen))
+	}
+	for l := range expected {
+		if !seen[l] {
+			t.Fatalf("snapshot is missing %v", l)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package k2tree
+
+import "container/heap"
+
+// A K2Tree is also a linear region quadtree over the grid of its cells. The
+// methods in this file treat it as an index of 2D points, where the point
+// (X, Y) is the cell in row X and column Y.
+
+// Point is a point on the grid indexed by a K2Tree.
+type Point struct {
+	X int
+	Y int
+}
+
+// AddPoint adds the point (x, y) to the index.
+func (k *K2Tree) AddPoint(x, y int) error {
+	return k.Add(x, y)
+}
+
+// PointsInRect returns the points in the rectangle [x0, x1) by [y0, y1), in
+// tree order.
+func (k *K2Tree) PointsInRect(x0, y0, x1, y1 int) []Point {
+	var out []Point
+	k.rectWalk(rect{x0, y0, x1, y1}, func(i, j int) {
+		out = append(out, Point{i, j})
+	}, nil)
+	return out
+}
+
+// CountInRect returns the number of points in the rectangle [x0, x1) by
+// [y0, y1). Regions of the tree that lie entirely within the rectangle are
+// counted with a handful of rank queries, without visiting their points.
+func (k *K2Tree) CountInRect(x0, y0, x1, y1 int) int {
+	n := 0
+	k.rectWalk(rect{x0, y0, x1, y1}, func(i, j int) {
+		n++
+	}, func(level, block int) {
+		n += k.countBelow(level, block)
+	})
+	return n
+}
+
+// NearestNeighbour returns up to n points closest to (x, y) by euclidean
+// distance, nearest first. It descends best-first: the blocks of the tree
+// are visited in order of their distance from (x, y), so only the blocks
+// nearer than the n-th point are expanded.
+func (k *K2Tree) NearestNeighbour(x, y, n int) []Point {
+	if k.levels == 0 || n <= 0 {
+		return nil
+	}
+	var out []Point
+	q := &nodeQueue{}
+	heap.Push(q, spatialNode{level: k.levels, dist: 0})
+	for q.Len() != 0 && len(out) < n {
+		nd := heap.Pop(q).(spatialNode)
+		if nd.level < 0 {
+			out = append(out, Point{nd.i, nd.j})
+			continue
+		}
+		k.children(nd.level, nd.block, nd.i, nd.j, func(child spatialNode) {
+			child.dist = child.bounds(k).distance(x, y)
+			heap.Push(q, child)
+		})
+	}
+	return out
+}
+
+// rect is the half-open rectangle [x0, x1) by [y0, y1).
+type rect struct {
+	x0, y0, x1, y1 int
+}
+
+func (r rect) intersects(o rect) bool {
+	return r.x0 < o.x1 && o.x0 < r.x1 && r.y0 < o.y1 && o.y0 < r.y1
+}
+
+func (r rect) contains(o rect) bool {
+	return r.x0 <= o.x0 && o.x1 <= r.x1 && r.y0 <= o.y0 && o.y1 <= r.y1
+}
+
+// distance returns the squared euclidean distance from x, y to the nearest
+// cell of the rectangle.
+func (r rect) distance(x, y int) int {
+	dx := 0
+	if x < r.x0 {
+		dx = r.x0 - x
+	} else if x >= r.x1 {
+		dx = x - (r.x1 - 1)
+	}
+	dy := 0
+	if y < r.y0 {
+		dy = r.y0 - y
+	} else if y >= r.y1 {
+		dy = y - (r.y1 - 1)
+	}
+	return dx*dx + dy*dy
+}
+
+// spatialNode is a block of the tree, or a single point if level is -1.
+// block is the index of the block on its level and i, j is its first cell.
+type spatialNode struct {
+	level int
+	block int
+	i     int
+	j     int
+	dist  int
+}
+
+// bounds returns the cells covered by the node.
+func (nd spatialNode) bounds(k *K2Tree) rect {
+	if nd.level < 0 {
+		return rect{nd.i, nd.j, nd.i + 1, nd.j + 1}
+	}
+	s := k.shape(nd.level)
+	return rect{nd.i, nd.j, nd.i + 1<<(s.rowShift+s.rowBits), nd.j + 1<<(s.colShift+s.colBits)}
+}
+
+// children calls fn with every non-empty child of the block-th block of
+// level, whose first cell is at i, j. The children of a leaf block are its
+// points.
+func (k *K2Tree) children(level, block, i, j int, fn func(spatialNode)) {
+	if level == 0 {
+		base := block * k.lk.bitsPerLayer
+		for off := 0; off < k.lk.bitsPerLayer; off++ {
+			if k.lbits.Get(base + off) {
+				fn(spatialNode{
+					level: -1,
+					i:     i + (off >> k.lk.shiftPerLayer),
+					j:     j + (off & k.lk.maskPerLayer),
+				})
+			}
+		}
+		return
+	}
+	s := k.shapes[level]
+	levelStart := k.levelOffsets[level]
+	base := levelStart + block*k.tk.bitsPerLayer
+	for off := 0; off < k.tk.bitsPerLayer; off++ {
+		if !k.tbits.Get(base + off) {
+			continue
+		}
+		x := off >> s.colBits
+		y := off & (1<<s.colBits - 1)
+		fn(spatialNode{
+			level: level - 1,
+			block: k.tbits.Count(levelStart, base+off),
+			i:     i + x<<s.rowShift,
+			j:     j + y<<s.colShift,
+		})
+	}
+}
+
+// rectWalk calls point for every point in r. If whole is not nil, it's
+// called instead for every block that lies entirely within r.
+func (k *K2Tree) rectWalk(r rect, point func(i, j int), whole func(level, block int)) {
+	if k.levels == 0 {
+		return
+	}
+	var visit func(nd spatialNode)
+	visit = func(nd spatialNode) {
+		b := nd.bounds(k)
+		if !r.intersects(b) {
+			return
+		}
+		if nd.level < 0 {
+			point(nd.i, nd.j)
+			return
+		}
+		if whole != nil && r.contains(b) {
+			whole(nd.level, nd.block)
+			return
+		}
+		k.children(nd.level, nd.block, nd.i, nd.j, visit)
+	}
+	visit(spatialNode{level: k.levels})
+}
+
+// countBelow returns the number of links below the block-th block of level.
+// The descendants of a block form a contiguous run of blocks on every level
+// below it, so the run is narrowed one level at a time.
+func (k *K2Tree) countBelow(level, block int) int {
+	lo, hi := block, block+1
+	for l := level; l > 0; l-- {
+		levelStart := k.levelOffsets[l]
+		lo, hi = k.tbits.Count(levelStart, levelStart+lo*k.tk.bitsPerLayer),
+			k.tbits.Count(levelStart, levelStart+hi*k.tk.bitsPerLayer)
+	}
+	return k.lbits.Count(lo*k.lk.bitsPerLayer, hi*k.lk.bitsPerLayer)
+}
+
+// nodeQueue is a min-heap of spatialNodes by distance.
+type nodeQueue []spatialNode
+
+func (q nodeQueue) Len() int            { return len(q) }
+func (q nodeQueue) Less(a, b int) bool  { return q[a].dist < q[b].dist }
+func (q nodeQueue) Swap(a, b int)       { q[a], q[b] = q[b], q[a] }
+func (q *nodeQueue) Push(x interface{}) { *q = append(*q, x.(spatialNode)) }
+
+func (q *nodeQueue) Pop() interface{} {
+	old := *q
+	x := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return x
+}
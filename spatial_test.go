@@ -0,0 +1,87 @@
+package k2tree
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func loadRandomPoints(t *testing.T, k2 *K2Tree, n, size int) map[Point]bool {
+	points := make(map[Point]bool)
+	for x := 0; x < n; x++ {
+		p := Point{rand.Intn(size), rand.Intn(size)}
+		err := k2.AddPoint(p.X, p.Y)
+		if err != nil {
+			t.Fatal(err)
+		}
+		points[p] = true
+	}
+	return points
+}
+
+func TestPointsInRect(t *testing.T) {
+	k2, err := NewWithConfig(FourFourConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	points := loadRandomPoints(t, k2, 3000, 1000)
+	for _, r := range []rect{
+		{0, 0, 1000, 1000},
+		{100, 200, 300, 250},
+		{511, 511, 513, 513},
+		{5000, 5000, 6000, 6000},
+	} {
+		expected := 0
+		for p := range points {
+			if p.X >= r.x0 && p.X < r.x1 && p.Y >= r.y0 && p.Y < r.y1 {
+				expected++
+			}
+		}
+		got := k2.PointsInRect(r.x0, r.y0, r.x1, r.y1)
+		for _, p := range got {
+			if !points[p] || !r.contains(rect{p.X, p.Y, p.X + 1, p.Y + 1}) {
+				t.Errorf("rect %v: unexpected point %v", r, p)
+			}
+		}
+		if len(got) != expected {
+			t.Errorf("rect %v: got %d points, expected %d", r, len(got), expected)
+		}
+		if c := k2.CountInRect(r.x0, r.y0, r.x1, r.y1); c != expected {
+			t.Errorf("rect %v: counted %d points, expected %d", r, c, expected)
+		}
+	}
+}
+
+func TestNearestNeighbour(t *testing.T) {
+	k2, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	points := loadRandomPoints(t, k2, 2000, 5000)
+	for x := 0; x < 20; x++ {
+		qx, qy := rand.Intn(6000), rand.Intn(6000)
+		dist := func(p Point) int {
+			return (p.X-qx)*(p.X-qx) + (p.Y-qy)*(p.Y-qy)
+		}
+		var all []int
+		for p := range points {
+			all = append(all, dist(p))
+		}
+		sort.Ints(all)
+		got := k2.NearestNeighbour(qx, qy, 5)
+		if len(got) != 5 {
+			t.Fatalf("expected 5 neighbours, got %d", len(got))
+		}
+		for n, p := range got {
+			if !points[p] {
+				t.Errorf("unknown point %v", p)
+			}
+			if dist(p) != all[n] {
+				t.Errorf("neighbour %d of (%d, %d): %v at distance %d, expected distance %d", n, qx, qy, p, dist(p), all[n])
+			}
+		}
+	}
+	if len(k2.NearestNeighbour(0, 0, len(points)+10)) != len(points) {
+		t.Error("expected every point")
+	}
+}
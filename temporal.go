@@ -0,0 +1,170 @@
+package k2tree
+
+import (
+	"errors"
+	"sort"
+)
+
+// Interval is a half-open span of time, [From, To).
+type Interval struct {
+	From int
+	To   int
+}
+
+// TemporalK2Tree is a K2Tree whose links are valid over intervals of time.
+// Each cell keeps a sorted list of disjoint intervals, aligned with the set
+// bits of the leaf layer like the values of a ValuedK2Tree. Every internal node
+// also tracks the earliest start and the latest end below it, so queries
+// over a window of time skip regions of the matrix that were never active in
+// it.
+type TemporalK2Tree struct {
+	tree      *K2Tree
+	intervals [][]Interval
+	// ranges holds the time spanned below each internal node, as computed
+	// by nodeRanges. It's rebuilt lazily after any change.
+	ranges [][]valueRange
+}
+
+// NewTemporal creates a new TemporalK2Tree with the default creation options.
+func NewTemporal() (*TemporalK2Tree, error) {
+	return NewTemporalWithConfig(DefaultConfig)
+}
+
+func NewTemporalWithConfig(config Config) (*TemporalK2Tree, error) {
+	k, err := NewWithConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return &TemporalK2Tree{tree: k}, nil
+}
+
+// AddInterval asserts that the link from node i to node j is active from
+// time from until, but not including, time to. Intervals that overlap or
+// touch an existing interval of the link are merged with it.
+func (tt *TemporalK2Tree) AddInterval(i, j, from, to int) error {
+	if from >= to {
+		return errors.New("interval must end after it starts")
+	}
+	tt.ranges = nil
+	added, err := tt.tree.TryAdd(i, j)
+	if err != nil {
+		return err
+	}
+	rank, _ := tt.tree.leafRank(i, j)
+	if added {
+		tt.intervals = append(tt.intervals, nil)
+		copy(tt.intervals[rank+1:], tt.intervals[rank:])
+		tt.intervals[rank] = nil
+	}
+	tt.intervals[rank] = mergeInterval(tt.intervals[rank], Interval{from, to})
+	return nil
+}
+
+// mergeInterval adds in to the sorted, disjoint intervals of ivs.
+func mergeInterval(ivs []Interval, in Interval) []Interval {
+	// First interval that ends at or after the start of in.
+	lo := sort.Search(len(ivs), func(x int) bool { return ivs[x].To >= in.From })
+	hi := lo
+	for hi < len(ivs) && ivs[hi].From <= in.To {
+		in.From = min(in.From, ivs[hi].From)
+		in.To = max(in.To, ivs[hi].To)
+		hi++
+	}
+	out := make([]Interval, 0, len(ivs)-(hi-lo)+1)
+	out = append(out, ivs[:lo]...)
+	out = append(out, in)
+	return append(out, ivs[hi:]...)
+}
+
+// Intervals returns the intervals over which the link from node i to node j
+// is active, in order.
+func (tt *TemporalK2Tree) Intervals(i, j int) []Interval {
+	rank, ok := tt.tree.leafRank(i, j)
+	if !ok {
+		return nil
+	}
+	return append([]Interval(nil), tt.intervals[rank]...)
+}
+
+// Snapshot returns a view of the links active at time t.
+func (tt *TemporalK2Tree) Snapshot(t int) *TemporalSnapshot {
+	return &TemporalSnapshot{
+		tree: tt,
+		t:    t,
+	}
+}
+
+// ActiveDuring calls fn for every link that is active at some point in the
+// window [t1, t2].
+func (tt *TemporalK2Tree) ActiveDuring(t1, t2 int, fn func(i, j int)) {
+	if tt.ranges == nil {
+		tt.ranges = tt.tree.nodeRanges(func(rank int) valueRange {
+			ivs := tt.intervals[rank]
+			if len(ivs) == 0 {
+				return emptyRange
+			}
+			return valueRange{min: ivs[0].From, max: ivs[len(ivs)-1].To}
+		})
+	}
+	keep := func(r valueRange) bool {
+		return r.min <= t2 && r.max > t1
+	}
+	tt.tree.walkRanges(tt.ranges, keep, func(i, j, rank int) {
+		if activeDuring(tt.intervals[rank], t1, t2) {
+			fn(i, j)
+		}
+	})
+}
+
+// activeAt returns whether any of the sorted intervals ivs contains t.
+func activeAt(ivs []Interval, t int) bool {
+	x := sort.Search(len(ivs), func(x int) bool { return ivs[x].To > t })
+	return x < len(ivs) && ivs[x].From <= t
+}
+
+// activeDuring returns whether any of the sorted intervals ivs overlaps the
+// window [t1, t2].
+func activeDuring(ivs []Interval, t1, t2 int) bool {
+	x := sort.Search(len(ivs), func(x int) bool { return ivs[x].To > t1 })
+	return x < len(ivs) && ivs[x].From <= t2
+}
+
+// TemporalSnapshot is a view of a TemporalK2Tree at a single point in time.
+// It reflects later changes to the tree.
+type TemporalSnapshot struct {
+	tree *TemporalK2Tree
+	t    int
+}
+
+// Contains returns whether the link from node i to node j is active at the
+// time of the snapshot.
+func (s *TemporalSnapshot) Contains(i, j int) bool {
+	rank, ok := s.tree.tree.leafRank(i, j)
+	return ok && activeAt(s.tree.intervals[rank], s.t)
+}
+
+// From returns the nodes that node i links to at the time of the snapshot,
+// in order.
+func (s *TemporalSnapshot) From(i int) []int {
+	var out []int
+	it := s.tree.tree.From(i)
+	for it.Next() {
+		if s.Contains(i, it.Value()) {
+			out = append(out, it.Value())
+		}
+	}
+	return out
+}
+
+// To returns the nodes that link to node j at the time of the snapshot, in
+// order.
+func (s *TemporalSnapshot) To(j int) []int {
+	var out []int
+	it := s.tree.tree.To(j)
+	for it.Next() {
+		if s.Contains(it.Value(), j) {
+			out = append(out, it.Value())
+		}
+	}
+	return out
+}
@@ -0,0 +1,100 @@
+package k2tree
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestMergeInterval(t *testing.T) {
+	var ivs []Interval
+	ivs = mergeInterval(ivs, Interval{10, 20})
+	ivs = mergeInterval(ivs, Interval{30, 40})
+	ivs = mergeInterval(ivs, Interval{0, 5})
+	expected := []Interval{{0, 5}, {10, 20}, {30, 40}}
+	if !reflect.DeepEqual(ivs, expected) {
+		t.Fatalf("got %v expected %v", ivs, expected)
+	}
+	ivs = mergeInterval(ivs, Interval{20, 30})
+	expected = []Interval{{0, 5}, {10, 40}}
+	if !reflect.DeepEqual(ivs, expected) {
+		t.Fatalf("got %v expected %v", ivs, expected)
+	}
+	ivs = mergeInterval(ivs, Interval{3, 50})
+	expected = []Interval{{0, 50}}
+	if !reflect.DeepEqual(ivs, expected) {
+		t.Fatalf("got %v expected %v", ivs, expected)
+	}
+}
+
+func TestTemporalSnapshot(t *testing.T) {
+	tt, err := NewTemporal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tt.AddInterval(1, 2, 0, 10)
+	tt.AddInterval(1, 3, 5, 15)
+	tt.AddInterval(1, 2, 20, 30)
+	tt.AddInterval(4, 2, 8, 9)
+	if err := tt.AddInterval(4, 2, 9, 9); err == nil {
+		t.Error("expected an error for an empty interval")
+	}
+
+	s := tt.Snapshot(7)
+	if !reflect.DeepEqual(s.From(1), []int{2, 3}) {
+		t.Errorf("From(1) at 7: %v", s.From(1))
+	}
+	if s.Contains(4, 2) {
+		t.Error("4 -> 2 shouldn't be active at 7")
+	}
+	s = tt.Snapshot(10)
+	if !reflect.DeepEqual(s.From(1), []int{3}) {
+		t.Errorf("From(1) at 10: %v", s.From(1))
+	}
+	s = tt.Snapshot(8)
+	if !reflect.DeepEqual(s.To(2), []int{1, 4}) {
+		t.Errorf("To(2) at 8: %v", s.To(2))
+	}
+	s = tt.Snapshot(17)
+	if len(s.From(1)) != 0 {
+		t.Errorf("From(1) at 17: %v", s.From(1))
+	}
+}
+
+func TestTemporalActiveDuring(t *testing.T) {
+	tt, err := NewTemporalWithConfig(FourFourConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := make(map[link][]Interval)
+	for x := 0; x < 2000; x++ {
+		l := link{rand.Intn(200), rand.Intn(200)}
+		// Correlate time with position, so that the window prunes.
+		from := l.i*10 + rand.Intn(50)
+		to := from + 1 + rand.Intn(20)
+		tt.AddInterval(l.i, l.j, from, to)
+		expected[l] = mergeInterval(expected[l], Interval{from, to})
+	}
+	t1, t2 := 500, 600
+	got := make(map[link]bool)
+	tt.ActiveDuring(t1, t2, func(i, j int) {
+		got[link{i, j}] = true
+	})
+	for l, ivs := range expected {
+		active := false
+		for _, iv := range ivs {
+			if iv.From <= t2 && iv.To > t1 {
+				active = true
+			}
+		}
+		if active != got[l] {
+			t.Errorf("link %v with %v: expected %v", l, ivs, active)
+		}
+		if !reflect.DeepEqual(tt.Intervals(l.i, l.j), ivs) {
+			t.Errorf("link %v: got intervals %v expected %v", l, tt.Intervals(l.i, l.j), ivs)
+		}
+	}
+	if len(got) == 0 {
+		t.Error("nothing was active")
+	}
+}
@@ -0,0 +1,148 @@
+package k2tree
+
+import (
+	"errors"
+	"sort"
+)
+
+// ErrTxnDone is returned by the methods of a Txn that has already been
+// committed or rolled back.
+var ErrTxnDone = errors.New("k2tree: transaction has already been committed or rolled back")
+
+// Txn is a group of changes to a K2Tree that are applied together, or not at
+// all. The changes are held in the Txn until Commit, so the tree doesn't see
+// them before then; the Txn itself sees them over the links the tree has
+// when it's asked.
+type Txn struct {
+	tree *K2Tree
+	// changes maps each link the Txn changes to whether it adds it.
+	changes map[link]bool
+	done    bool
+}
+
+// Begin starts a transaction on the tree.
+func (k *K2Tree) Begin() *Txn {
+	return &Txn{
+		tree:    k,
+		changes: make(map[link]bool),
+	}
+}
+
+// Add asserts the existence of a link from node i to node j once the
+// transaction commits.
+func (t *Txn) Add(i, j int) error {
+	if t.done {
+		return ErrTxnDone
+	}
+	err := checkNodes(i, j)
+	if err != nil {
+		return err
+	}
+	t.changes[link{i, j}] = true
+	return nil
+}
+
+// Remove deletes the link from node i to node j, if it exists, once the
+// transaction commits.
+func (t *Txn) Remove(i, j int) error {
+	if t.done {
+		return ErrTxnDone
+	}
+	t.changes[link{i, j}] = false
+	return nil
+}
+
+// Contains returns whether there is a link from node i to node j, taking the
+// changes of the transaction into account.
+func (t *Txn) Contains(i, j int) bool {
+	if added, ok := t.changes[link{i, j}]; ok {
+		return added
+	}
+	return t.tree.Contains(i, j)
+}
+
+// Commit applies the changes of the transaction to the tree. If an error is
+// returned, the tree is as it was, shape and all, and the transaction is
+// still open to be committed again or rolled back.
+//
+// The changes are made to a copy of the tree that shares its pages, as
+// Snapshot does, which is swapped in once they've all been made. Trees on
+// bitarrays that can't share their storage are copied whole. A persistent
+// tree logs the changes as a group, which is replayed whole or not at all.
+func (t *Txn) Commit() error {
+	if t.done {
+		return ErrTxnDone
+	}
+	k := t.tree
+	err := k.writable()
+	if err != nil {
+		return err
+	}
+	var adds, removes []link
+	for l, added := range t.changes {
+		if added {
+			adds = append(adds, l)
+		} else if k.Contains(l.i, l.j) {
+			removes = append(removes, l)
+		}
+	}
+	if len(adds)+len(removes) == 0 {
+		t.done = true
+		return nil
+	}
+	sortByRow(adds)
+	sortByRow(removes)
+	c, err := k.Snapshot()
+	if err != nil {
+		return err
+	}
+	defer c.release()
+	var changes []Change
+	for _, l := range adds {
+		added, err := c.insert(l.i, l.j)
+		if err != nil {
+			return err
+		}
+		if added {
+			changes = append(changes, Change{Kind: LinkAdded, From: l.i, To: l.j})
+		}
+	}
+	for _, l := range removes {
+		bitoff, _ := c.findLeaf(l.i, l.j)
+		c.lbits.Set(bitoff, false)
+		changes = append(changes, Change{Kind: LinkRemoved, From: l.i, To: l.j})
+	}
+	err = k.logTxn(adds, removes)
+	if err != nil {
+		return err
+	}
+	levels := k.levels
+	k.tbits, k.lbits = c.tbits, c.lbits
+	k.count = c.count
+	k.levels = c.levels
+	k.levelOffsets = c.levelOffsets
+	k.shapes = c.shapes
+	t.done = true
+	k.notifyGrown(levels)
+	k.notify(changes...)
+	k.changed()
+	return nil
+}
+
+// Rollback discards the changes of the transaction.
+func (t *Txn) Rollback() error {
+	if t.done {
+		return ErrTxnDone
+	}
+	t.done = true
+	t.changes = nil
+	return nil
+}
+
+// sortByRow sorts links by row then column.
+func sortByRow(links []link) {
+	sort.Slice(links, func(x, y int) bool {
+		a, b := links[x], links[y]
+		return a.i < b.i || (a.i == b.i && a.j < b.j)
+	})
+}
@@ -0,0 +1,208 @@
+package k2tree
+
+import (
+	"math/rand"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestTxn(t *testing.T) {
+	for _, config := range []Config{DefaultConfig, FourFourConfig} {
+		k, err := NewWithConfig(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		simpleLoad(k)
+		expected := linkSet(k)
+		// The snapshot shares pages with the tree that Commit writes.
+		s, err := k.Snapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		before := linkSet(s)
+
+		txn := k.Begin()
+		txn.Remove(20, 41)
+		txn.Add(5000, 7000)
+		txn.Add(3, 3)
+		txn.Remove(3, 3)
+		txn.Add(20, 41)
+		txn.Remove(999, 999)
+		if !txn.Contains(5000, 7000) || !txn.Contains(20, 41) || txn.Contains(3, 3) {
+			t.Error("transaction doesn't see its own writes")
+		}
+		if k.Contains(5000, 7000) || k.levels != s.levels {
+			t.Error("tree changed before Commit")
+		}
+		txn.Remove(20, 41)
+		err = txn.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+		delete(expected, link{20, 41})
+		expected[link{5000, 7000}] = true
+		checkLinks(t, k, expected)
+
+		// The tree is shaped as if the links had been added directly.
+		direct, err := NewWithConfig(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		simpleLoad(direct)
+		direct.Remove(20, 41)
+		direct.Add(5000, 7000)
+		if k.levels != direct.levels || !reflect.DeepEqual(k.levelOffsets, direct.levelOffsets) {
+			t.Errorf("expected levels %d at %v, got %d at %v", direct.levels, direct.levelOffsets, k.levels, k.levelOffsets)
+		}
+		if !reflect.DeepEqual(linkSet(s), before) {
+			t.Error("Commit changed a snapshot")
+		}
+		s.Close()
+
+		if txn.Add(1, 1) != ErrTxnDone || txn.Commit() != ErrTxnDone || txn.Rollback() != ErrTxnDone {
+			t.Error("expected ErrTxnDone from a committed transaction")
+		}
+	}
+}
+
+func TestTxnRollback(t *testing.T) {
+	k, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	simpleLoad(k)
+	expected := linkSet(k)
+	offsets := append([]int(nil), k.levelOffsets...)
+	txn := k.Begin()
+	txn.Add(100000, 3)
+	txn.Remove(20, 41)
+	err = txn.Rollback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(linkSet(k), expected) || !reflect.DeepEqual(k.levelOffsets, offsets) {
+		t.Error("Rollback changed the tree")
+	}
+	if txn.Commit() != ErrTxnDone {
+		t.Error("expected ErrTxnDone from Commit after Rollback")
+	}
+}
+
+func TestTxnCommitFails(t *testing.T) {
+	limit := 200
+	k, err := NewWithBitArrays(func() BitArray {
+		return &fullArray{limit: limit}
+	}, func() BitArray {
+		return &boolArray{}
+	}, DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for x := 0; x < 5; x++ {
+		k.Add(x*37, x*91)
+	}
+	expected := linkSet(k)
+	levels := k.levels
+	offsets := append([]int(nil), k.levelOffsets...)
+	txn := k.Begin()
+	for x := 0; x < 100; x++ {
+		txn.Add(x*37+1, x*91)
+	}
+	txn.Remove(0, 0)
+	err = txn.Commit()
+	if err != errFull {
+		t.Fatalf("expected %v from Commit, got %v", errFull, err)
+	}
+	if !reflect.DeepEqual(linkSet(k), expected) || k.levels != levels || !reflect.DeepEqual(k.levelOffsets, offsets) {
+		t.Error("a failed Commit changed the tree")
+	}
+
+	// The transaction is still open after a failed Commit.
+	limit = 1 << 20
+	err = txn.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for x := 0; x < 100; x++ {
+		expected[link{x*37 + 1, x * 91}] = true
+	}
+	delete(expected, link{0, 0})
+	if !reflect.DeepEqual(linkSet(k), expected) {
+		t.Error("a retried Commit didn't apply the transaction")
+	}
+	if err := txn.Commit(); err != ErrTxnDone {
+		t.Errorf("expected %v committing twice, got %v", ErrTxnDone, err)
+	}
+
+	limit = 200
+	txn = k.Begin()
+	txn.Add(1<<20, 1<<20)
+	if err := txn.Commit(); err != errFull {
+		t.Fatalf("expected %v from Commit, got %v", errFull, err)
+	}
+	err = txn.Rollback()
+	if err != nil {
+		t.Fatalf("couldn't roll back a failed Commit: %v", err)
+	}
+}
+
+func TestTxnPersistent(t *testing.T) {
+	path, cleanup := tempTreePath(t)
+	defer cleanup()
+	k, err := Open(path, testOpenOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := make(map[link]bool)
+	addRandom(t, k, expected, 200, 1000)
+	txn := k.Begin()
+	for x := 0; x < 20; x++ {
+		l := link{rand.Intn(5000), rand.Intn(5000)}
+		txn.Add(l.i, l.j)
+		expected[l] = true
+	}
+	err = txn.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	crash(t, k)
+	k, err = Open(path, testOpenOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkLinks(t, k, expected)
+
+	// A transaction missing its last record is lost whole.
+	txn = k.Begin()
+	for x := 0; x < 10; x++ {
+		txn.Add(6000+x, x)
+	}
+	err = txn.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	crash(t, k)
+	fi, err := os.Stat(path + ".wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Truncate(path+".wal", fi.Size()-walRecordSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err = Open(path, testOpenOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkLinks(t, k, expected)
+	// Writes after the replay follow on from the intact records.
+	addRandom(t, k, expected, 10, 1000)
+	crash(t, k)
+	k, err = Open(path, testOpenOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer k.Close()
+	checkLinks(t, k, expected)
+}
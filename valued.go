@@ -0,0 +1,104 @@
+package k2tree
+
+// ValuedK2Tree is a K2Tree that stores an integer value with every link, in
+// the style of a k2-raster. Values are kept in an array aligned with the set
+// bits of the leaf layer, so the rank of a cell's leaf bit is the index of its
+// value. Every internal node also keeps the smallest and largest value below
+// it, which lets Filter skip whole regions of the matrix.
+type ValuedK2Tree struct {
+	tree   *K2Tree
+	values []int
+	// ranges holds, for each level above the leaves, the range of values
+	// below each set bit on that level, in order. It's rebuilt lazily after
+	// any change.
+	ranges [][]valueRange
+}
+
+// NewValued creates a new ValuedK2Tree with the default creation options.
+func NewValued() (*ValuedK2Tree, error) {
+	return NewValuedWithConfig(DefaultConfig)
+}
+
+func NewValuedWithConfig(config Config) (*ValuedK2Tree, error) {
+	k, err := NewWithConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return &ValuedK2Tree{tree: k}, nil
+}
+
+// Get returns the value stored for the link from node i to node j. ok is
+// false if there is no such link.
+func (v *ValuedK2Tree) Get(i, j int) (value int, ok bool) {
+	rank, ok := v.tree.leafRank(i, j)
+	if !ok {
+		return 0, false
+	}
+	return v.values[rank], true
+}
+
+// Set adds a link from node i to node j, if it doesn't exist, and stores
+// value with it.
+func (v *ValuedK2Tree) Set(i, j int, value int) error {
+	v.ranges = nil
+	added, err := v.tree.TryAdd(i, j)
+	if err != nil {
+		return err
+	}
+	rank, _ := v.tree.leafRank(i, j)
+	if !added {
+		v.values[rank] = value
+		return nil
+	}
+	v.values = append(v.values, 0)
+	copy(v.values[rank+1:], v.values[rank:])
+	v.values[rank] = value
+	return nil
+}
+
+// Remove deletes the link from node i to node j and its value, if it exists.
+func (v *ValuedK2Tree) Remove(i, j int) error {
+	rank, ok := v.tree.leafRank(i, j)
+	if !ok {
+		return nil
+	}
+	v.ranges = nil
+	err := v.tree.Remove(i, j)
+	if err != nil {
+		return err
+	}
+	v.values = append(v.values[:rank], v.values[rank+1:]...)
+	return nil
+}
+
+// Contains returns whether there is a link from node i to node j.
+func (v *ValuedK2Tree) Contains(i, j int) bool {
+	return v.tree.Contains(i, j)
+}
+
+func (v *ValuedK2Tree) From(i int) *Iterator {
+	return v.tree.From(i)
+}
+
+func (v *ValuedK2Tree) To(j int) *Iterator {
+	return v.tree.To(j)
+}
+
+// Filter calls fn for every link whose value lies in [lo, hi]. Regions of
+// the matrix whose values all fall outside the interval are skipped without
+// being visited.
+func (v *ValuedK2Tree) Filter(lo, hi int, fn func(i, j, value int)) {
+	if v.ranges == nil {
+		v.ranges = v.tree.nodeRanges(func(rank int) valueRange {
+			return valueRange{v.values[rank], v.values[rank]}
+		})
+	}
+	keep := func(r valueRange) bool {
+		return r.overlaps(lo, hi)
+	}
+	v.tree.walkRanges(v.ranges, keep, func(i, j, rank int) {
+		if val := v.values[rank]; val >= lo && val <= hi {
+			fn(i, j, val)
+		}
+	})
+}
@@ -0,0 +1,86 @@
+package k2tree
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestValuedSetGet(t *testing.T) {
+	v, err := NewValued()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := make(map[link]int)
+	for x := 0; x < 3000; x++ {
+		l := link{rand.Intn(5000), rand.Intn(5000)}
+		val := rand.Intn(1000)
+		err := v.Set(l.i, l.j, val)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected[l] = val
+	}
+	n := 0
+	for l := range expected {
+		if n%3 == 0 {
+			v.Remove(l.i, l.j)
+			delete(expected, l)
+		}
+		n++
+	}
+	for l, val := range expected {
+		got, ok := v.Get(l.i, l.j)
+		if !ok || got != val {
+			t.Fatalf("Get(%d, %d) = %d, %v; expected %d", l.i, l.j, got, ok, val)
+		}
+	}
+	if _, ok := v.Get(6000, 6000); ok {
+		t.Error("found a value for a missing link")
+	}
+	if len(v.values) != len(expected) {
+		t.Errorf("expected %d values, got %d", len(expected), len(v.values))
+	}
+}
+
+func TestValuedFilter(t *testing.T) {
+	v, err := NewValuedWithConfig(FourFourConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := make(map[link]int)
+	for x := 0; x < 2000; x++ {
+		l := link{rand.Intn(300), rand.Intn(300)}
+		// Make values correlate with position, so that filtering prunes.
+		val := l.i + rand.Intn(10)
+		v.Set(l.i, l.j, val)
+		expected[l] = val
+	}
+	lo, hi := 100, 120
+	got := make(map[link]int)
+	v.Filter(lo, hi, func(i, j, val int) {
+		got[link{i, j}] = val
+	})
+	for l, val := range expected {
+		inRange := val >= lo && val <= hi
+		gotval, ok := got[l]
+		if inRange != ok {
+			t.Errorf("link %v with value %d: filtered %v", l, val, ok)
+		}
+		if ok && gotval != val {
+			t.Errorf("link %v: got value %d, expected %d", l, gotval, val)
+		}
+	}
+	if len(got) == 0 {
+		t.Error("filter found nothing")
+	}
+	v.Set(0, 0, 110)
+	found := false
+	v.Filter(lo, hi, func(i, j, val int) {
+		if i == 0 && j == 0 {
+			found = true
+		}
+	})
+	if !found {
+		t.Error("filter did not see a new value")
+	}
+}
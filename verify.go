@@ -0,0 +1,233 @@
+package k2tree
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"math/bits"
+	"os"
+	"strings"
+)
+
+// CorruptError is returned by Verify when a file fails its checks. It lists
+// every problem found.
+type CorruptError struct {
+	Path     string
+	Problems []string
+}
+
+func (e *CorruptError) Error() string {
+	return fmt.Sprintf("k2tree: %s is corrupt: %s", e.Path, strings.Join(e.Problems, "; "))
+}
+
+// Verify checks the pagefile at path without opening it as a tree. It checks
+// the magic header, that the page count in the header matches the length of
+// the file, the checksums of the root slots, the free list, the user
+// metadata and every page a checkpoint uses, that no free page is in use,
+// and that the newest checkpoint is a well-formed tree: its level offsets
+// increase towards the leaves, and the number of set bits on each level is
+// the number of blocks on the level below.
+//
+// Pages that no checkpoint uses aren't checked. Verify returns
+// a *CorruptError if the file fails any check, and an *ErrVersionMismatch
+// if it's in another version of the format.
+func Verify(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	e := &CorruptError{Path: path}
+	problem := func(format string, args ...interface{}) {
+		e.Problems = append(e.Problems, fmt.Sprintf(format, args...))
+	}
+	if fi.Size() < headerSize {
+		problem("file is %d bytes, shorter than its header", fi.Size())
+		return e
+	}
+	hdr := make([]byte, userMetadataOffset)
+	_, err = f.ReadAt(hdr, 0)
+	if err != nil {
+		return err
+	}
+	var h header
+	copy(h.Magic[:], hdr)
+	h.PageSize = int64(binary.BigEndian.Uint64(hdr[8:]))
+	h.Pages = int64(binary.BigEndian.Uint64(hdr[16:]))
+	err = checkVersion(h.Magic)
+	if _, ok := err.(*ErrVersionMismatch); ok {
+		return err
+	}
+	if err != nil {
+		problem("bad magic header %q", h.Magic[:])
+		return e
+	}
+	if h.PageSize <= blockSize || h.PageSize%blockSize != 0 {
+		problem("bad page size %d", h.PageSize)
+		return e
+	}
+	pagesize := int(h.PageSize)
+	pages := int(h.Pages)
+	if want := headerSize + h.Pages*h.PageSize; h.Pages < 0 || want != fi.Size() {
+		problem("header says %d pages, but the file is %d bytes", h.Pages, fi.Size())
+		pages = int((fi.Size() - headerSize) / h.PageSize)
+	}
+	for _, off := range rootSlotOffsets {
+		r := decodeRootSlot(hdr[off:])
+		if r.Seq != 0 && r.CRC != r.checksum() {
+			problem("root slot at %d fails its checksum", off)
+		}
+	}
+	roots := validRoots(hdr, pages, pagesize-blockSize)
+	free, ok := decodeFreeList(hdr[freeListOffset:])
+	if !ok {
+		problem("free list is damaged")
+	}
+	for _, e := range free {
+		if e.end() > pages {
+			problem("free pages %d-%d are past the end of the file", e.start, e.end()-1)
+		}
+		for _, r := range roots {
+			if e.start < int(r.StartPage+r.NumPages) && int(r.StartPage) < e.end() {
+				problem("free pages %d-%d overlap checkpoint %d", e.start, e.end()-1, r.Seq)
+			}
+		}
+	}
+	md := make([]byte, headerSize-userMetadataOffset)
+	_, err = f.ReadAt(md, userMetadataOffset)
+	if err != nil {
+		return err
+	}
+	md, err = decodeUserMetadata(md)
+	if err == nil {
+		_, err = decodeMetadata(md)
+	}
+	if err != nil {
+		problem("user metadata: %v", err)
+	}
+	page := make([]byte, pagesize)
+	for x, r := range roots {
+		name := "checkpoint"
+		if x != 0 {
+			name = "fallback checkpoint"
+		}
+		image := make([]byte, 0, r.ImageLen)
+		intact := true
+		for p := int(r.StartPage); p < int(r.StartPage+r.NumPages); p++ {
+			_, err = f.ReadAt(page, int64(headerSize+p*pagesize))
+			if err != nil {
+				return err
+			}
+			if !pageValid(page) {
+				problem("%s %d: page %d fails its checksum", name, r.Seq, p)
+				intact = false
+			}
+			n := min(pagesize-blockSize, int(r.ImageLen)-len(image))
+			image = append(image, page[blockSize:blockSize+n]...)
+		}
+		if !intact {
+			continue
+		}
+		if crc32.Checksum(image, castagnoli) != r.ImageCRC {
+			problem("%s %d: image fails its checksum", name, r.Seq)
+			continue
+		}
+		if x != 0 {
+			continue
+		}
+		for _, p := range checkImage(image) {
+			problem("%s %d: %s", name, r.Seq, p)
+		}
+	}
+	if len(e.Problems) != 0 {
+		return e
+	}
+	return nil
+}
+
+// checkImage returns the ways in which a serialized tree isn't well-formed.
+func checkImage(b []byte) []string {
+	im, err := parseImage(b)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	var out []string
+	problem := func(format string, args ...interface{}) {
+		out = append(out, fmt.Sprintf(format, args...))
+	}
+	tdef, err := layerDefForK(im.tk)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	ldef, err := layerDefForK(im.lk)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	if im.levels == 0 {
+		if im.tlen != 0 || im.llen != 0 {
+			problem("tree with no levels has %d tree bits and %d leaf bits", im.tlen, im.llen)
+		}
+		return out
+	}
+	if im.llen%ldef.bitsPerLayer != 0 {
+		problem("%d leaf bits is not a whole number of blocks", im.llen)
+	}
+	if im.offsets[im.levels] != 0 {
+		problem("top level starts at %d, not 0", im.offsets[im.levels])
+	}
+	// end returns where level l stops in the tree bits.
+	end := func(l int) int {
+		if l == 1 {
+			return im.tlen
+		}
+		return im.offsets[l-1]
+	}
+	for l := im.levels; l > 0; l-- {
+		if im.offsets[l] < 0 || im.offsets[l] > end(l) || end(l) > im.tlen {
+			problem("level offsets %v are not increasing towards the leaves", im.offsets[1:])
+			return out
+		}
+	}
+	if end(im.levels) != tdef.bitsPerLayer {
+		problem("top level is %d bits, not one block", end(im.levels))
+	}
+	for l := im.levels; l > 0; l-- {
+		n := end(l) - im.offsets[l]
+		if n%tdef.bitsPerLayer != 0 {
+			problem("level %d is %d bits, not a whole number of blocks", l, n)
+			continue
+		}
+		set := countPacked(im.tbits, im.offsets[l], end(l))
+		blocks := im.llen / ldef.bitsPerLayer
+		if l > 1 {
+			blocks = (end(l-1) - im.offsets[l-1]) / tdef.bitsPerLayer
+		}
+		if set != blocks {
+			problem("level %d has %d bits set, but level %d has %d blocks", l, set, l-1, blocks)
+		}
+	}
+	return out
+}
+
+// countPacked counts the set bits in [from, to) of the packed bits b.
+func countPacked(b []byte, from, to int) int {
+	var n int
+	for ; from < to && from%8 != 0; from++ {
+		if b[from/8]&(0x80>>uint(from%8)) != 0 {
+			n++
+		}
+	}
+	for ; from+8 <= to; from += 8 {
+		n += bits.OnesCount8(b[from/8])
+	}
+	for ; from < to; from++ {
+		if b[from/8]&(0x80>>uint(from%8)) != 0 {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,151 @@
+package k2tree
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// checkpointed returns a closed tree file holding two checkpoints of
+// random links, and the links of the newest.
+func checkpointed(t *testing.T, path string) map[link]bool {
+	k, err := Open(path, testOpenOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := make(map[link]bool)
+	addRandom(t, k, expected, 500, 2000)
+	err = k.Checkpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addRandom(t, k, expected, 500, 2000)
+	err = k.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return expected
+}
+
+// expectCorrupt checks that Verify reports a problem containing want.
+func expectCorrupt(t *testing.T, path, want string) {
+	t.Helper()
+	err := Verify(path)
+	e, ok := err.(*CorruptError)
+	if !ok {
+		t.Fatalf("expected a CorruptError, got %v", err)
+	}
+	for _, p := range e.Problems {
+		if strings.Contains(p, want) {
+			return
+		}
+	}
+	t.Fatalf("expected a problem containing %q, got %v", want, e.Problems)
+}
+
+func TestVerify(t *testing.T) {
+	path, cleanup := tempTreePath(t)
+	defer cleanup()
+	checkpointed(t, path)
+	err := Verify(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyPageChecksum(t *testing.T) {
+	path, cleanup := tempTreePath(t)
+	defer cleanup()
+	expected := checkpointed(t, path)
+	pf, err := openPagefile(path, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	live := pf.roots()[0]
+	pf.pageData(int(live.StartPage))[100] ^= 0x01
+	err = pf.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectCorrupt(t, path, "fails its checksum")
+
+	// Opening falls back to the previous checkpoint and replays nothing, so
+	// only the links of the first checkpoint survive.
+	k, err := Open(path, testOpenOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer k.Close()
+	for _, l := range k.links() {
+		if !expected[l] {
+			t.Fatalf("unexpected link %v", l)
+		}
+	}
+	if len(k.links()) >= len(expected) {
+		t.Error("expected to fall back to the older checkpoint")
+	}
+}
+
+func TestVerifyFileLength(t *testing.T) {
+	path, cleanup := tempTreePath(t)
+	defer cleanup()
+	checkpointed(t, path)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(make([]byte, blockSize))
+	f.Close()
+	expectCorrupt(t, path, "pages, but the file is")
+}
+
+func TestVerifyMagic(t *testing.T) {
+	path, cleanup := tempTreePath(t)
+	defer cleanup()
+	checkpointed(t, path)
+	f, err := os.OpenFile(path, os.O_WRONLY, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte("XX"), 0)
+	f.Close()
+	expectCorrupt(t, path, "bad magic header")
+}
+
+func TestCheckImage(t *testing.T) {
+	k, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for x := 0; x < 300; x++ {
+		k.Add(x*7%101, x*13%89)
+	}
+	image := k.encodeImage()
+	if problems := checkImage(image); len(problems) != 0 {
+		t.Fatal(problems)
+	}
+
+	// Clear the last set bit of the tree bits, which leaves a block on the
+	// level below with nothing pointing at it.
+	treeBits := imageHeaderSize + (k.levels+1)*8*5
+	last := treeBits + (k.tbits.Len()+7)/8 - 1
+	for image[last] == 0 {
+		last--
+	}
+	bad := append([]byte(nil), image...)
+	bad[last] &= bad[last] - 1
+	problems := checkImage(bad)
+	if len(problems) != 1 || !strings.Contains(problems[0], "bits set") {
+		t.Fatalf("expected a bit count problem, got %v", problems)
+	}
+
+	// Swap the offsets of the two lowest levels.
+	bad = append([]byte(nil), image...)
+	offsets := imageHeaderSize
+	copy(bad[offsets+8:], image[offsets+16:offsets+24])
+	copy(bad[offsets+16:], image[offsets+8:offsets+16])
+	problems = checkImage(bad)
+	if len(problems) == 0 || !strings.Contains(problems[0], "not increasing") {
+		t.Fatalf("expected an offsets problem, got %v", problems)
+	}
+}
@@ -0,0 +1,328 @@
+package k2tree
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// SyncPolicy selects when writes to the write-ahead log are fsynced.
+type SyncPolicy int
+
+const (
+	// SyncAlways fsyncs the log before every mutating call returns, so no
+	// acknowledged write is lost even if the machine goes down.
+	SyncAlways SyncPolicy = iota
+	// SyncNever leaves flushing the log to the OS. Writes survive the
+	// process being killed, but not a power loss; call Sync to force them
+	// out.
+	SyncNever
+)
+
+type walOp byte
+
+const (
+	walAdd walOp = iota + 1
+	walRemove
+	// walTxn heads a transaction, and its I is the number of records in it,
+	// which follow it.
+	walTxn
+)
+
+/*
+WAL Layout:
+
+The log is a sequence of fixed-size records, appended as they're made:
+
+	CRC32C (4B, over the rest of the record)
+	LSN (8B/uint64)
+	Op (1B)
+	I (8B/int64)
+	J (8B/int64)
+
+LSNs increase by one with every record, and continue across checkpoints,
+which empty the log. Replay stops at the first record that's short or fails
+its checksum: that's where a write was torn. A transaction is a walTxn record
+followed by the records of its changes, and replay stops at its head unless
+they're all intact, so it's applied whole or not at all.
+*/
+
+const walRecordSize = 4 + 8 + 1 + 8 + 8
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+type walRecord struct {
+	lsn uint64
+	op  walOp
+	i   int
+	j   int
+}
+
+type wal struct {
+	// file is nil for a read-only log that doesn't exist.
+	file    *os.File
+	policy  SyncPolicy
+	nextLSN uint64
+	// records counts the records in the log since it was last emptied.
+	records int
+	// end is the size of the log up to its last whole record.
+	end int64
+	// torn is set when a failed append couldn't be cut off the log, so the
+	// next append has to cut it off first.
+	torn bool
+	buf  []byte
+	// readOnly is set on logs that are only replayed.
+	readOnly bool
+}
+
+// openWAL opens, or creates, the log at filename.
+func openWAL(filename string, policy SyncPolicy) (*wal, error) {
+	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	return &wal{
+		file:    f,
+		policy:  policy,
+		nextLSN: 1,
+	}, nil
+}
+
+// openWALReadOnly opens the log at filename for replay only. A log that
+// doesn't exist is empty.
+func openWALReadOnly(filename string) (*wal, error) {
+	f, err := os.Open(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return &wal{
+		file:     f,
+		nextLSN:  1,
+		readOnly: true,
+	}, nil
+}
+
+// replay calls fn for every intact record in the log whose LSN is after
+// since, then cuts off anything after the last intact record so that new
+// records follow on from it. A read-only log is left as it is.
+func (w *wal) replay(since uint64, fn func(r walRecord) error) error {
+	w.nextLSN = since + 1
+	if w.file == nil {
+		return nil
+	}
+	_, err := w.file.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	w.records = 0
+	var end int64
+	rec := make([]byte, walRecordSize)
+	for {
+		_, err := io.ReadFull(w.file, rec)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		r, ok := decodeWALRecord(rec)
+		if !ok {
+			break
+		}
+		group := []walRecord{r}
+		if r.op == walTxn {
+			group, err = w.readTxn(r)
+			if err != nil {
+				return err
+			}
+			if group == nil {
+				break
+			}
+		}
+		end += int64(len(group)) * walRecordSize
+		w.records += len(group)
+		for _, r := range group {
+			if r.lsn <= since || r.op == walTxn {
+				continue
+			}
+			err = fn(r)
+			if err != nil {
+				return err
+			}
+		}
+		if last := group[len(group)-1].lsn; last > since {
+			w.nextLSN = last + 1
+		}
+	}
+	if w.readOnly {
+		return nil
+	}
+	w.end = end
+	return w.rewind()
+}
+
+// readTxn reads the records of the transaction headed by txn, and returns
+// them after it, or nil if any of them is torn.
+func (w *wal) readTxn(txn walRecord) ([]walRecord, error) {
+	group := []walRecord{txn}
+	rec := make([]byte, walRecordSize)
+	for x := 0; x < txn.i; x++ {
+		_, err := io.ReadFull(w.file, rec)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		r, ok := decodeWALRecord(rec)
+		if !ok || r.op == walTxn || r.lsn != txn.lsn+uint64(x)+1 {
+			return nil, nil
+		}
+		group = append(group, r)
+	}
+	return group, nil
+}
+
+func decodeWALRecord(rec []byte) (walRecord, bool) {
+	if binary.BigEndian.Uint32(rec) != crc32.Checksum(rec[4:], castagnoli) {
+		return walRecord{}, false
+	}
+	r := walRecord{
+		lsn: binary.BigEndian.Uint64(rec[4:]),
+		op:  walOp(rec[12]),
+		i:   int(int64(binary.BigEndian.Uint64(rec[13:]))),
+		j:   int(int64(binary.BigEndian.Uint64(rec[21:]))),
+	}
+	switch r.op {
+	case walAdd, walRemove:
+	case walTxn:
+		if r.i <= 0 {
+			return walRecord{}, false
+		}
+	default:
+		return walRecord{}, false
+	}
+	return r, true
+}
+
+// append writes a record of op for every link in links in one write, and
+// syncs them according to the policy.
+func (w *wal) append(op walOp, links ...link) error {
+	w.buf = w.buf[:0]
+	for _, l := range links {
+		w.encode(op, l)
+	}
+	return w.flush(len(links))
+}
+
+// appendTxn writes a transaction that adds the links of adds and removes
+// the links of removes in one write, and syncs it according to the policy.
+func (w *wal) appendTxn(adds, removes []link) error {
+	n := len(adds) + len(removes)
+	if n == 0 {
+		return nil
+	}
+	w.buf = w.buf[:0]
+	w.encode(walTxn, link{n, 0})
+	for _, l := range adds {
+		w.encode(walAdd, l)
+	}
+	for _, l := range removes {
+		w.encode(walRemove, l)
+	}
+	return w.flush(n + 1)
+}
+
+// encode adds a record of op on l to the buffer.
+func (w *wal) encode(op walOp, l link) {
+	var rec [walRecordSize]byte
+	binary.BigEndian.PutUint64(rec[4:], w.nextLSN)
+	rec[12] = byte(op)
+	binary.BigEndian.PutUint64(rec[13:], uint64(int64(l.i)))
+	binary.BigEndian.PutUint64(rec[21:], uint64(int64(l.j)))
+	binary.BigEndian.PutUint32(rec[:], crc32.Checksum(rec[4:], castagnoli))
+	w.buf = append(w.buf, rec[:]...)
+	w.nextLSN++
+}
+
+// flush writes the n records in the buffer to the log. If that fails, the
+// log is cut back to where it was, and their LSNs are handed out again.
+func (w *wal) flush(n int) error {
+	err := w.write()
+	if err != nil {
+		w.nextLSN -= uint64(n)
+		w.torn = true
+		w.rewind()
+		return err
+	}
+	w.end += int64(len(w.buf))
+	w.records += n
+	return nil
+}
+
+// write writes the buffer to the end of the log and syncs it according to
+// the policy.
+func (w *wal) write() error {
+	if w.torn {
+		err := w.rewind()
+		if err != nil {
+			return err
+		}
+	}
+	_, err := w.file.Write(w.buf)
+	if err != nil {
+		return err
+	}
+	if w.policy == SyncAlways {
+		return w.file.Sync()
+	}
+	return nil
+}
+
+// rewind cuts off anything in the log after its last whole record, such as
+// the torn bytes of a failed append.
+func (w *wal) rewind() error {
+	err := w.file.Truncate(w.end)
+	if err != nil {
+		return err
+	}
+	_, err = w.file.Seek(w.end, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	w.torn = false
+	return nil
+}
+
+// lastLSN returns the LSN of the last record written.
+func (w *wal) lastLSN() uint64 {
+	return w.nextLSN - 1
+}
+
+// reset empties the log, once its records are safely checkpointed.
+func (w *wal) reset() error {
+	err := w.file.Truncate(0)
+	if err != nil {
+		return err
+	}
+	_, err = w.file.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	w.records = 0
+	w.end = 0
+	w.torn = false
+	return w.file.Sync()
+}
+
+func (w *wal) sync() error {
+	return w.file.Sync()
+}
+
+func (w *wal) close() error {
+	if w.file == nil {
+		return nil
+	}
+	return w.file.Close()
+}